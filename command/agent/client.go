@@ -0,0 +1,113 @@
+package agent
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "io"
+    "net"
+    "sync"
+    "syscall"
+)
+
+// Client talks to a Server, its calls are serialized on one connection
+type Client struct {
+    mu sync.Mutex
+    conn net.Conn
+    scanner *bufio.Scanner
+    encoder *json.Encoder
+}
+
+// Dial connects to the agent listening on socket
+func Dial(socket string) (*Client, error) {
+    conn, err := net.Dial("unix", socket)
+    if err != nil {
+        return nil, err
+    }
+    scanner := bufio.NewScanner(conn)
+    scanner.Buffer(nil, int(maxRequestSize)*2)
+    return &Client{conn: conn, scanner: scanner, encoder: json.NewEncoder(conn)}, nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+    return c.conn.Close()
+}
+
+// Start starts the command described by request, Request.Op is set to OpStart
+func (c *Client) Start(request Request) (*Response, error) {
+    request.Op = OpStart
+    return c.call(&request)
+}
+
+// Status returns the state of a job
+func (c *Client) Status(id string) (*Response, error) {
+    return c.call(&Request{Op: OpStatus, ID: id})
+}
+
+// Signal sends sig to the process group of a job
+func (c *Client) Signal(id string, sig syscall.Signal) (*Response, error) {
+    return c.call(&Request{Op: OpSignal, ID: id, Signal: int(sig)})
+}
+
+// Wait waits for a job to exit and returns its result
+func (c *Client) Wait(id string) (*Response, error) {
+    return c.call(&Request{Op: OpWait, ID: id})
+}
+
+// Stream writes the output of a job from offset to stdout and stderr until it exits, and returns its result
+func (c *Client) Stream(id string, offset int, stdout io.Writer, stderr io.Writer) (*Response, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if err := c.encoder.Encode(&Request{Op: OpStream, ID: id, Offset: offset}); err != nil {
+        return nil, err
+    }
+    for {
+        response, err := c.receive()
+        if err != nil || response.Done {
+            return response, err
+        }
+        w := stdout
+        if response.Stream == StreamStderr {
+            w = stderr
+        }
+        if w == nil {
+            continue
+        }
+        if _, err := w.Write(response.Data); err != nil {
+            return nil, err
+        }
+    }
+}
+
+func (c *Client) call(request *Request) (*Response, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if err := c.encoder.Encode(request); err != nil {
+        return nil, err
+    }
+    return c.receive()
+}
+
+// receive reads a response, a response error is returned as the matching error of this package if any
+func (c *Client) receive() (*Response, error) {
+    if !c.scanner.Scan() {
+        if err := c.scanner.Err(); err != nil {
+            return nil, err
+        }
+        return nil, io.ErrUnexpectedEOF
+    }
+    response := &Response{}
+    if err := json.Unmarshal(c.scanner.Bytes(), response); err != nil {
+        return nil, err
+    }
+    if response.Error != "" {
+        for _, known := range []error{ErrPermissionDenied, ErrJobNotFound, ErrServerClosed} {
+            if response.Error == known.Error() {
+                return response, known
+            }
+        }
+        return response, errors.New(response.Error)
+    }
+    return response, nil
+}
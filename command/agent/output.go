@@ -0,0 +1,84 @@
+package agent
+
+import (
+    "sync"
+
+    "github.com/gaodb1210/go-common/util/unit"
+)
+
+type chunk struct {
+    stream string
+    data []byte
+}
+
+// output keeps the recent output chunks of a job for streaming, the oldest chunks are dropped over maxSize
+type output struct {
+    mu sync.Mutex
+    maxSize int
+    size int
+    // base is the index of chunks[0]
+    base int
+    chunks []chunk
+    changed chan struct{}
+    closed bool
+}
+
+func newOutput(maxSize unit.Bytes) *output {
+    return &output{maxSize: int(maxSize), changed: make(chan struct{})}
+}
+
+// writer returns a writer which appends chunks tagged with stream
+func (o *output) writer(stream string) *outputWriter {
+    return &outputWriter{output: o, stream: stream}
+}
+
+func (o *output) append(stream string, p []byte) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    if len(p) > o.maxSize {
+        p = p[len(p)-o.maxSize:]
+    }
+    o.chunks = append(o.chunks, chunk{stream: stream, data: append([]byte(nil), p...)})
+    o.size += len(p)
+    for o.size > o.maxSize {
+        o.size -= len(o.chunks[0].data)
+        o.chunks[0] = chunk{}
+        o.chunks = o.chunks[1:]
+        o.base++
+    }
+    close(o.changed)
+    o.changed = make(chan struct{})
+}
+
+// close marks the end of the output
+func (o *output) close() {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    o.closed = true
+    close(o.changed)
+    o.changed = make(chan struct{})
+}
+
+// read returns the chunks from offset and the offset of the next chunk,
+// changed is closed on the next append or close, closed reports the end of the output
+func (o *output) read(offset int) (chunks []chunk, next int, changed <-chan struct{}, closed bool) {
+    o.mu.Lock()
+    defer o.mu.Unlock()
+    if offset < o.base {
+        offset = o.base
+    }
+    if i := offset - o.base; i < len(o.chunks) {
+        chunks = append(chunks, o.chunks[i:]...)
+    }
+    return chunks, o.base + len(o.chunks), o.changed, o.closed
+}
+
+type outputWriter struct {
+    output *output
+    stream string
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+    w.output.append(w.stream, p)
+    return len(p), nil
+}
@@ -0,0 +1,23 @@
+package agent
+
+import (
+    "net"
+    "syscall"
+)
+
+// peerCredentials returns the pid, uid and gid of the peer process by SO_PEERCRED
+func peerCredentials(conn *net.UnixConn) (*syscall.Ucred, error) {
+    raw, err := conn.SyscallConn()
+    if err != nil {
+        return nil, err
+    }
+    var cred *syscall.Ucred
+    var credErr error
+    err = raw.Control(func(fd uintptr) {
+        cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return cred, credErr
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+    "time"
+)
+
+const (
+    // OpStart starts a command, the response carries the job id
+    OpStart = "start"
+    // OpStatus returns the state of a job
+    OpStatus = "status"
+    // OpStream streams the output of a job from Request.Offset until it exits
+    OpStream = "stream"
+    // OpSignal sends Request.Signal to the process group of a job
+    OpSignal = "signal"
+    // OpWait waits for a job to exit and returns its result
+    OpWait = "wait"
+)
+
+const (
+    // StreamStdout tags the stdout chunks of a stream
+    StreamStdout = "stdout"
+    // StreamStderr tags the stderr chunks of a stream
+    StreamStderr = "stderr"
+)
+
+// Request is a JSON line sent by a client, every request gets one response, except OpStream which gets
+// one response per output chunk followed by a response with Done set
+type Request struct {
+    Op string `json:"op"`
+    // ID is the job id for OpStatus, OpStream, OpSignal and OpWait
+    ID string `json:"id,omitempty"`
+    // Command, Args, Dir, Env, User and Timeout describe the command for OpStart,
+    // Command must be an absolute path, User is the target user, empty means the user of the agent
+    Command string `json:"command,omitempty"`
+    Args []string `json:"args,omitempty"`
+    Dir string `json:"dir,omitempty"`
+    Env []string `json:"env,omitempty"`
+    User string `json:"user,omitempty"`
+    Timeout time.Duration `json:"timeout,omitempty"`
+    // Offset is the output chunk to start streaming from for OpStream
+    Offset int `json:"offset,omitempty"`
+    // Signal is the signal number for OpSignal
+    Signal int `json:"signal,omitempty"`
+}
+
+// Response is a JSON line sent by the agent
+type Response struct {
+    // Error is set when the request fails
+    Error string `json:"error,omitempty"`
+    ID string `json:"id,omitempty"`
+    Pid int `json:"pid,omitempty"`
+    // State is one of command.StateRunning, command.StatePaused and command.StateExited
+    State int `json:"state"`
+    // ExitCode, Status and Err are set once the job exited
+    ExitCode int `json:"exit_code"`
+    Status int `json:"status"`
+    Err string `json:"err,omitempty"`
+    StartTime time.Time `json:"start_time,omitempty"`
+    EndTime time.Time `json:"end_time,omitempty"`
+    // Stream, Data and Offset carry an output chunk of OpStream, Offset is the index of the chunk
+    Stream string `json:"stream,omitempty"`
+    Data []byte `json:"data,omitempty"`
+    Offset int `json:"offset,omitempty"`
+    // Done ends an OpStream
+    Done bool `json:"done,omitempty"`
+}
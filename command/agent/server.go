@@ -0,0 +1,447 @@
+package agent
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/gaodb1210/go-common/command"
+    "github.com/gaodb1210/go-common/util/unit"
+)
+
+const (
+    defaultSocketMode = 0660
+    defaultMaxOutput = 1 * unit.MB
+    defaultRetention = 10 * time.Minute
+    maxRequestSize = 1 * unit.MB
+)
+
+var (
+    ErrPermissionDenied = errors.New("permission denied")
+    ErrJobNotFound = errors.New("job not found")
+    ErrUnknownOp = errors.New("unknown operation")
+    ErrServerClosed = errors.New("agent server closed")
+)
+
+// Rule allows the matching peers to run the listed commands as the listed users
+type Rule struct {
+    // UIDs and GIDs match the peer process, a peer matches when its uid or gid is listed, both empty match no peer
+    UIDs []uint32
+    GIDs []uint32
+    // Commands are the absolute paths of the allowed executables
+    Commands []string
+    // Users are the allowed target users, an empty string allows the user of the agent
+    Users []string
+    // Env are the names of the environment variables a peer may set, the others are dropped,
+    // the command gets the environment of the agent with the allowed variables of the request
+    Env []string
+    // Dirs are the absolute paths of the allowed working directories, an empty request dir is always allowed
+    Dirs []string
+}
+
+// Config configures a Server
+type Config struct {
+    // Socket is the path of the Unix domain socket
+    Socket string
+    // SocketMode is the file mode of the socket, zero means 0660, the peers are also checked by the rules
+    SocketMode os.FileMode
+    // Rules allow peers to start commands, a start request matching no rule is denied
+    Rules []Rule
+    // MaxOutput is the output kept for streaming per job, zero means 1MB
+    MaxOutput unit.Bytes
+    // Retention is how long an exited job is kept for status and wait, zero means 10 minutes
+    Retention time.Duration
+}
+
+// Server exposes a Runner over a Unix domain socket with a JSON lines protocol.
+// Peers are identified by SO_PEERCRED, a job is only visible to the peer user which started it and to root.
+type Server struct {
+    config Config
+    runner *command.Runner
+    ctx context.Context
+    cancel context.CancelFunc
+
+    mu sync.Mutex
+    listener *net.UnixListener
+    conns map[net.Conn]struct{}
+    jobs map[string]*job
+    seq uint64
+    closed bool
+    wg sync.WaitGroup
+}
+
+type job struct {
+    id string
+    owner uint32
+    execution *command.Execution
+    output *output
+}
+
+// NewServer creates a Server which runs commands with the config of runner
+func NewServer(runner *command.Runner, config Config) *Server {
+    if runner == nil {
+        runner = &command.Runner{}
+    }
+    if config.SocketMode == 0 {
+        config.SocketMode = defaultSocketMode
+    }
+    if config.MaxOutput <= 0 {
+        config.MaxOutput = defaultMaxOutput
+    }
+    if config.Retention <= 0 {
+        config.Retention = defaultRetention
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    return &Server{
+        config: config,
+        runner: runner.Clone(),
+        ctx: ctx,
+        cancel: cancel,
+        conns: make(map[net.Conn]struct{}),
+        jobs: make(map[string]*job),
+    }
+}
+
+// Listen creates the socket, a stale socket file is removed first
+func (s *Server) Listen() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed {
+        return ErrServerClosed
+    }
+    if err := os.MkdirAll(filepath.Dir(s.config.Socket), 0755); err != nil {
+        return err
+    }
+    if err := os.Remove(s.config.Socket); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: s.config.Socket, Net: "unix"})
+    if err != nil {
+        return err
+    }
+    if err := os.Chmod(s.config.Socket, s.config.SocketMode); err != nil {
+        _ = listener.Close()
+        return err
+    }
+    s.listener = listener
+    return nil
+}
+
+// Serve accepts connections until the server is closed
+func (s *Server) Serve() error {
+    s.mu.Lock()
+    listener := s.listener
+    s.mu.Unlock()
+    if listener == nil {
+        return ErrServerClosed
+    }
+    for {
+        conn, err := listener.AcceptUnix()
+        if err != nil {
+            if s.ctx.Err() != nil {
+                return ErrServerClosed
+            }
+            return err
+        }
+        s.mu.Lock()
+        if s.closed {
+            s.mu.Unlock()
+            _ = conn.Close()
+            return ErrServerClosed
+        }
+        s.conns[conn] = struct{}{}
+        s.wg.Add(1)
+        s.mu.Unlock()
+        go s.serveConn(conn)
+    }
+}
+
+// ListenAndServe creates the socket and accepts connections until the server is closed
+func (s *Server) ListenAndServe() error {
+    if err := s.Listen(); err != nil {
+        return err
+    }
+    return s.Serve()
+}
+
+// Close stops accepting connections, closes the open connections, cancels the running jobs and waits for them
+func (s *Server) Close() error {
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        return nil
+    }
+    s.closed = true
+    s.cancel()
+    var err error
+    if s.listener != nil {
+        err = s.listener.Close()
+    }
+    for conn := range s.conns {
+        _ = conn.Close()
+    }
+    jobs := make([]*job, 0, len(s.jobs))
+    for _, j := range s.jobs {
+        jobs = append(jobs, j)
+    }
+    s.mu.Unlock()
+    for _, j := range jobs {
+        <-j.execution.Done()
+    }
+    s.wg.Wait()
+    return err
+}
+
+func (s *Server) serveConn(conn *net.UnixConn) {
+    defer s.wg.Done()
+    defer func() {
+        s.mu.Lock()
+        delete(s.conns, conn)
+        s.mu.Unlock()
+        _ = conn.Close()
+    }()
+    peer, err := peerCredentials(conn)
+    if err != nil {
+        fmt.Printf("agent: get peer credentials error: %v\n", err)
+        return
+    }
+    scanner := bufio.NewScanner(conn)
+    scanner.Buffer(nil, int(maxRequestSize))
+    encoder := json.NewEncoder(conn)
+    send := func(response *Response) bool {
+        return encoder.Encode(response) == nil
+    }
+    for scanner.Scan() {
+        var request Request
+        if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+            if !send(&Response{Error: err.Error()}) {
+                return
+            }
+            continue
+        }
+        if !s.handle(peer, &request, send) {
+            return
+        }
+    }
+}
+
+// handle serves one request, it returns false when the connection is broken
+func (s *Server) handle(peer *syscall.Ucred, request *Request, send func(*Response) bool) bool {
+    if request.Op == OpStart {
+        j, err := s.start(peer, request)
+        if err != nil {
+            return send(&Response{Error: err.Error()})
+        }
+        return send(s.status(j))
+    }
+    j, err := s.job(peer, request.ID)
+    if err != nil {
+        return send(&Response{Error: err.Error()})
+    }
+    switch request.Op {
+    case OpStatus:
+        return send(s.status(j))
+    case OpStream:
+        return s.stream(j, request.Offset, send)
+    case OpSignal:
+        if err := j.execution.Signal(syscall.Signal(request.Signal)); err != nil {
+            return send(&Response{ID: j.id, Error: err.Error()})
+        }
+        return send(s.status(j))
+    case OpWait:
+        select {
+        case <-j.execution.Done():
+        case <-s.ctx.Done():
+            return send(&Response{ID: j.id, Error: ErrServerClosed.Error()})
+        }
+        return send(s.status(j))
+    }
+    return send(&Response{Error: fmt.Sprintf("%s: %q", ErrUnknownOp, request.Op)})
+}
+
+// start checks the request against the rules and starts the command
+func (s *Server) start(peer *syscall.Ucred, request *Request) (*job, error) {
+    rule := s.match(peer, request)
+    if rule == nil {
+        fmt.Printf("agent: deny uid %d gid %d to run %s as %q in %q\n", peer.Uid, peer.Gid, request.Command, request.User, request.Dir)
+        return nil, ErrPermissionDenied
+    }
+    env, dropped := rule.filterEnv(request.Env)
+    if len(dropped) > 0 {
+        fmt.Printf("agent: drop environment variables %v of uid %d\n", dropped, peer.Uid)
+    }
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        return nil, ErrServerClosed
+    }
+    s.seq++
+    id := strconv.FormatUint(s.seq, 10)
+    s.mu.Unlock()
+
+    runner := s.runner.Clone()
+    if request.User != "" {
+        runner.SetUser(request.User)
+    }
+    out := newOutput(s.config.MaxOutput)
+    execution, err := runner.Start(s.ctx, command.Spec{
+        Name: request.Command,
+        Args: request.Args,
+        Dir: request.Dir,
+        Env: env,
+        Stdout: out.writer(StreamStdout),
+        Stderr: out.writer(StreamStderr),
+        Timeout: request.Timeout,
+    })
+    if err != nil {
+        return nil, err
+    }
+    j := &job{id: id, owner: peer.Uid, execution: execution, output: out}
+    s.mu.Lock()
+    s.jobs[id] = j
+    s.mu.Unlock()
+    fmt.Printf("agent: uid %d starts job %s: %s as %q, pid %d\n", peer.Uid, id, request.Command, request.User, execution.Pid())
+    go func() {
+        <-execution.Done()
+        out.close()
+        time.AfterFunc(s.config.Retention, func() {
+            s.mu.Lock()
+            delete(s.jobs, id)
+            s.mu.Unlock()
+        })
+    }()
+    return j, nil
+}
+
+// match returns the first rule which allows the peer to run the command as the target user in the dir, nil if none
+func (s *Server) match(peer *syscall.Ucred, request *Request) *Rule {
+    if !cleanAbs(request.Command) || request.Dir != "" && !cleanAbs(request.Dir) {
+        return nil
+    }
+    for i := range s.config.Rules {
+        rule := &s.config.Rules[i]
+        if rule.matchPeer(peer) && contains(rule.Commands, request.Command) && contains(rule.Users, request.User) &&
+            (request.Dir == "" || contains(rule.Dirs, request.Dir)) {
+            return rule
+        }
+    }
+    return nil
+}
+
+// job returns the job visible to the peer
+func (s *Server) job(peer *syscall.Ucred, id string) (*job, error) {
+    s.mu.Lock()
+    j, ok := s.jobs[id]
+    s.mu.Unlock()
+    if !ok {
+        return nil, ErrJobNotFound
+    }
+    if peer.Uid != 0 && peer.Uid != j.owner {
+        return nil, ErrPermissionDenied
+    }
+    return j, nil
+}
+
+func (s *Server) status(j *job) *Response {
+    response := &Response{
+        ID: j.id,
+        Pid: j.execution.Pid(),
+        State: j.execution.State(),
+    }
+    select {
+    case <-j.execution.Done():
+        result, err := j.execution.Wait()
+        response.State = command.StateExited
+        response.ExitCode = result.ExitCode
+        response.Status = result.Status
+        response.StartTime = result.StartTime
+        response.EndTime = result.EndTime
+        if err != nil {
+            response.Err = err.Error()
+        }
+    default:
+    }
+    return response
+}
+
+// stream sends the output chunks from offset until the job exits
+func (s *Server) stream(j *job, offset int, send func(*Response) bool) bool {
+    for {
+        chunks, next, changed, closed := j.output.read(offset)
+        for i, c := range chunks {
+            if !send(&Response{ID: j.id, Stream: c.stream, Data: c.data, Offset: next - len(chunks) + i}) {
+                return false
+            }
+        }
+        offset = next
+        if closed {
+            response := s.status(j)
+            response.Offset = offset
+            response.Done = true
+            return send(response)
+        }
+        select {
+        case <-changed:
+        case <-s.ctx.Done():
+            return send(&Response{ID: j.id, Error: ErrServerClosed.Error()})
+        }
+    }
+}
+
+func (rule *Rule) matchPeer(peer *syscall.Ucred) bool {
+    for _, uid := range rule.UIDs {
+        if uid == peer.Uid {
+            return true
+        }
+    }
+    for _, gid := range rule.GIDs {
+        if gid == peer.Gid {
+            return true
+        }
+    }
+    return false
+}
+
+// filterEnv returns the environment of the agent with the allowed variables of env, and the dropped names
+func (rule *Rule) filterEnv(env []string) ([]string, []string) {
+    if len(env) == 0 {
+        return nil, nil
+    }
+    var allowed, dropped []string
+    for _, kv := range env {
+        name := strings.SplitN(kv, "=", 2)[0]
+        if strings.Contains(kv, "=") && contains(rule.Env, name) {
+            allowed = append(allowed, kv)
+        } else {
+            dropped = append(dropped, name)
+        }
+    }
+    if len(allowed) == 0 {
+        return nil, dropped
+    }
+    // the later value of a variable wins
+    return append(os.Environ(), allowed...), dropped
+}
+
+func cleanAbs(path string) bool {
+    return filepath.IsAbs(path) && filepath.Clean(path) == path
+}
+
+func contains(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
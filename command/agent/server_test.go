@@ -0,0 +1,143 @@
+package agent
+
+import (
+    "bytes"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "syscall"
+    "testing"
+    "time"
+
+    "github.com/gaodb1210/go-common/command"
+)
+
+func startServer(t *testing.T, rules []Rule) (*Server, *Client, func()) {
+    dir, err := ioutil.TempDir("", "agent")
+    if err != nil {
+        t.Fatal(err)
+    }
+    socket := filepath.Join(dir, "agent.sock")
+    server := NewServer(nil, Config{Socket: socket, Rules: rules})
+    if err := server.Listen(); err != nil {
+        t.Fatal(err)
+    }
+    go func() {
+        _ = server.Serve()
+    }()
+    client, err := Dial(socket)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return server, client, func() {
+        _ = client.Close()
+        _ = server.Close()
+        _ = os.RemoveAll(dir)
+    }
+}
+
+func TestServer_StartStreamWait(t *testing.T) {
+    _, client, cleanup := startServer(t, []Rule{{UIDs: []uint32{uint32(os.Getuid())}, Commands: []string{"/bin/sh"}, Users: []string{""}}})
+    defer cleanup()
+
+    started, err := client.Start(Request{Command: "/bin/sh", Args: []string{"-c", "echo out; echo err >&2; exit 3"}, Timeout: 3 * time.Second})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if started.ID == "" || started.Pid == 0 {
+        t.Fatalf("unexpected start response: %+v", started)
+    }
+    var stdout, stderr bytes.Buffer
+    result, err := client.Stream(started.ID, 0, &stdout, &stderr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stdout.String() != "out\n" || stderr.String() != "err\n" {
+        t.Errorf("unexpected output: %q %q", stdout.String(), stderr.String())
+    }
+    if result.State != command.StateExited || result.ExitCode != 3 {
+        t.Errorf("unexpected result: %+v", result)
+    }
+    waited, err := client.Wait(started.ID)
+    if err != nil || waited.ExitCode != 3 {
+        t.Errorf("unexpected wait: %+v %v", waited, err)
+    }
+}
+
+func TestServer_Signal(t *testing.T) {
+    _, client, cleanup := startServer(t, []Rule{{GIDs: []uint32{uint32(os.Getgid())}, Commands: []string{"/bin/sleep"}, Users: []string{""}}})
+    defer cleanup()
+
+    started, err := client.Start(Request{Command: "/bin/sleep", Args: []string{"10"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    status, err := client.Status(started.ID)
+    if err != nil || status.State != command.StateRunning {
+        t.Fatalf("unexpected status: %+v %v", status, err)
+    }
+    if _, err := client.Signal(started.ID, syscall.SIGTERM); err != nil {
+        t.Fatal(err)
+    }
+    result, err := client.Wait(started.ID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.State != command.StateExited || result.ExitCode != -1 {
+        t.Errorf("unexpected result: %+v", result)
+    }
+}
+
+func TestServer_Denied(t *testing.T) {
+    _, client, cleanup := startServer(t, []Rule{
+        {UIDs: []uint32{uint32(os.Getuid()) + 1}, Commands: []string{"/bin/sh"}, Users: []string{""}},
+        {Commands: []string{"/bin/echo"}, Users: []string{"nobody"}},
+        {UIDs: []uint32{uint32(os.Getuid())}, Commands: []string{"/bin/true"}, Users: []string{""}, Dirs: []string{"/tmp"}},
+    })
+    defer cleanup()
+
+    for _, request := range []Request{
+        {Command: "/bin/sh"},
+        // a rule without uids and gids matches no peer
+        {Command: "/bin/echo"},
+        {Command: "/bin/true", Dir: "/"},
+        {Command: "/bin/true", Dir: "/tmp/../"},
+        {Command: "/bin/../bin/echo", User: "nobody"},
+        {Command: "echo", User: "nobody"},
+    } {
+        if _, err := client.Start(request); err != ErrPermissionDenied {
+            t.Errorf("expect %v for %+v, got %v", ErrPermissionDenied, request, err)
+        }
+    }
+    if _, err := client.Status("1"); err != ErrJobNotFound {
+        t.Errorf("expect %v, got %v", ErrJobNotFound, err)
+    }
+}
+
+func TestServer_FilterEnv(t *testing.T) {
+    server, client, cleanup := startServer(t, []Rule{
+        {UIDs: []uint32{uint32(os.Getuid())}, Commands: []string{"/bin/sh"}, Users: []string{""}, Env: []string{"ALLOWED"}, Dirs: []string{"/tmp"}},
+    })
+    defer cleanup()
+    if info, err := os.Stat(server.config.Socket); err != nil || info.Mode().Perm() != defaultSocketMode {
+        t.Errorf("unexpected socket mode: %v %v", info.Mode(), err)
+    }
+
+    started, err := client.Start(Request{
+        Command: "/bin/sh",
+        Args: []string{"-c", "echo \"$ALLOWED:$LD_PRELOAD:$(pwd)\""},
+        Dir: "/tmp",
+        Env: []string{"ALLOWED=1", "LD_PRELOAD=/tmp/evil.so", "PATH=/tmp"},
+        Timeout: 3 * time.Second,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    var stdout bytes.Buffer
+    if _, err := client.Stream(started.ID, 0, &stdout, &stdout); err != nil {
+        t.Fatal(err)
+    }
+    if stdout.String() != "1::/tmp\n" {
+        t.Errorf("unexpected output: %q", stdout.String())
+    }
+}
@@ -0,0 +1,220 @@
+package command
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf8"
+)
+
+const (
+    asciicastVersion = 2
+    asciicastOutput = "o"
+    defaultAsciicastWidth = 80
+    defaultAsciicastHeight = 24
+    asciicastMaxLineSize = 16 * 1024 * 1024
+)
+
+var (
+    ErrAsciicastFormat = errors.New("invalid asciicast v2 recording")
+)
+
+// AsciicastHeader is the first line of an asciicast v2 recording
+type AsciicastHeader struct {
+    Version int `json:"version"`
+    Width int `json:"width"`
+    Height int `json:"height"`
+    Timestamp int64 `json:"timestamp,omitempty"`
+    Command string `json:"command,omitempty"`
+    Title string `json:"title,omitempty"`
+    Env map[string]string `json:"env,omitempty"`
+}
+
+// Recorder records command output with timing into the asciicast v2 format
+type Recorder struct {
+    mu sync.Mutex
+    w io.Writer
+    start time.Time
+    err error
+    writers []*recordWriter
+}
+
+// NewRecorder writes the header to w, and returns a Recorder which appends output events to w
+func NewRecorder(w io.Writer, header AsciicastHeader) (*Recorder, error) {
+    start := time.Now()
+    header.Version = asciicastVersion
+    if header.Width <= 0 {
+        header.Width = defaultAsciicastWidth
+    }
+    if header.Height <= 0 {
+        header.Height = defaultAsciicastHeight
+    }
+    if header.Timestamp == 0 {
+        header.Timestamp = start.Unix()
+    }
+    line, err := json.Marshal(header)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := w.Write(append(line, '\n')); err != nil {
+        return nil, err
+    }
+    return &Recorder{w: w, start: start}, nil
+}
+
+// Wrap returns a writer which writes to w and records the data as output events, a nil w only records.
+// Pass the wrapped stdoutWriter and stderrWriter to SyncRun, and call Flush after it returns.
+func (r *Recorder) Wrap(w io.Writer) io.Writer {
+    rw := &recordWriter{recorder: r, w: w}
+    r.mu.Lock()
+    r.writers = append(r.writers, rw)
+    r.mu.Unlock()
+    return rw
+}
+
+// Flush records the incomplete UTF-8 sequences held back at the end of the wrapped writers,
+// the invalid bytes are recorded as U+FFFD. It returns the first error writing the recording.
+func (r *Recorder) Flush() error {
+    r.mu.Lock()
+    writers := r.writers
+    r.mu.Unlock()
+    for _, w := range writers {
+        w.flush()
+    }
+    return r.Err()
+}
+
+// Err returns the first error writing the recording
+func (r *Recorder) Err() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.err
+}
+
+// record appends an output event, data must be valid UTF-8
+func (r *Recorder) record(data string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.err != nil {
+        return
+    }
+    elapsed := time.Since(r.start).Seconds()
+    line, err := json.Marshal([]interface{}{elapsed, asciicastOutput, data})
+    if err == nil {
+        _, err = r.w.Write(append(line, '\n'))
+    }
+    r.err = err
+}
+
+// recordWriter holds back an incomplete UTF-8 sequence at the end of a write until the next write
+type recordWriter struct {
+    recorder *Recorder
+    w io.Writer
+    mu sync.Mutex
+    pending []byte
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    data := append(w.pending, p...)
+    end := len(data)
+    // find the start of a trailing incomplete rune
+    for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+        if utf8.RuneStart(data[i]) {
+            if !utf8.FullRune(data[i:]) {
+                end = i
+            }
+            break
+        }
+    }
+    if end > 0 {
+        w.recorder.record(string(data[:end]))
+    }
+    w.pending = append([]byte(nil), data[end:]...)
+    if w.w == nil {
+        return len(p), nil
+    }
+    return w.w.Write(p)
+}
+
+// flush records the pending bytes
+func (w *recordWriter) flush() {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if len(w.pending) == 0 {
+        return
+    }
+    w.recorder.record(strings.ToValidUTF8(string(w.pending), string(utf8.RuneError)))
+    w.pending = nil
+}
+
+// Player replays an asciicast v2 recording
+type Player struct {
+    // Speed is the replay speed, 2 replays twice as fast, zero or less means 1
+    Speed float64
+    // MaxIdle caps the wait between two events, zero means no cap
+    MaxIdle time.Duration
+}
+
+// Play writes the output events read from r to w with their timing, it returns the recording header
+func (p *Player) Play(ctx context.Context, r io.Reader, w io.Writer) (*AsciicastHeader, error) {
+    speed := p.Speed
+    if speed <= 0 {
+        speed = 1
+    }
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(nil, asciicastMaxLineSize)
+    // 1. read header
+    if !scanner.Scan() {
+        if err := scanner.Err(); err != nil {
+            return nil, err
+        }
+        return nil, ErrAsciicastFormat
+    }
+    header := &AsciicastHeader{}
+    if err := json.Unmarshal(scanner.Bytes(), header); err != nil || header.Version != asciicastVersion {
+        return nil, ErrAsciicastFormat
+    }
+    // 2. replay events
+    var last float64
+    for scanner.Scan() {
+        var event []interface{}
+        if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+            return header, fmt.Errorf("%w: %s", ErrAsciicastFormat, scanner.Text())
+        }
+        at, ok1 := event[0].(float64)
+        kind, ok2 := event[1].(string)
+        data, ok3 := event[2].(string)
+        if !ok1 || !ok2 || !ok3 {
+            return header, fmt.Errorf("%w: %s", ErrAsciicastFormat, scanner.Text())
+        }
+        wait := time.Duration((at - last) / speed * float64(time.Second))
+        if p.MaxIdle > 0 && wait > p.MaxIdle {
+            wait = p.MaxIdle
+        }
+        last = at
+        if wait > 0 {
+            timer := time.NewTimer(wait)
+            select {
+            case <-timer.C:
+            case <-ctx.Done():
+                timer.Stop()
+                return header, ctx.Err()
+            }
+        }
+        if kind != asciicastOutput {
+            continue
+        }
+        if _, err := io.WriteString(w, data); err != nil {
+            return header, err
+        }
+    }
+    return header, scanner.Err()
+}
@@ -0,0 +1,104 @@
+package command
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestRecorder_RecordAndPlay(t *testing.T) {
+    var recording, stdout bytes.Buffer
+    recorder, err := NewRecorder(&recording, AsciicastHeader{Command: "sh", Title: "test"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    w := recorder.Wrap(&stdout)
+    r := newRunner()
+    _, err = r.Run(context.Background(), Spec{
+        Name: "sh",
+        Args: []string{"-c", "printf one; sleep 0.3; printf ' two'"},
+        Stdout: w,
+        Stderr: w,
+        Timeout: 3 * time.Second,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := recorder.Err(); err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(strings.TrimSpace(recording.String()), "\n")
+    if len(lines) != 3 {
+        t.Fatalf("expect header and 2 events, got %q", recording.String())
+    }
+    var event []interface{}
+    if err := json.Unmarshal([]byte(lines[2]), &event); err != nil {
+        t.Fatal(err)
+    }
+    if at := event[0].(float64); at < 0.3 || event[1] != "o" || event[2] != " two" {
+        t.Errorf("unexpected event: %v", event)
+    }
+
+    var played bytes.Buffer
+    start := time.Now()
+    header, err := (&Player{Speed: 10}).Play(context.Background(), &recording, &played)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if header.Command != "sh" || header.Width != 80 {
+        t.Errorf("unexpected header: %+v", header)
+    }
+    if played.String() != stdout.String() || played.String() != "one two" {
+        t.Errorf("expect %q, got %q", stdout.String(), played.String())
+    }
+    if elapsed := time.Since(start); elapsed < 30*time.Millisecond || elapsed > 300*time.Millisecond {
+        t.Errorf("unexpected replay time %s", elapsed)
+    }
+}
+
+func TestRecorder_SplitRune(t *testing.T) {
+    var recording bytes.Buffer
+    recorder, err := NewRecorder(&recording, AsciicastHeader{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    w := recorder.Wrap(nil)
+    data := []byte("中文")
+    _, _ = w.Write(data[:2])
+    _, _ = w.Write(data[2:4])
+    _, _ = w.Write(data[4:])
+
+    var played bytes.Buffer
+    if _, err := (&Player{MaxIdle: time.Millisecond}).Play(context.Background(), &recording, &played); err != nil {
+        t.Fatal(err)
+    }
+    if played.String() != "中文" {
+        t.Errorf("expect %q, got %q", "中文", played.String())
+    }
+}
+
+func TestRecorder_Flush(t *testing.T) {
+    var recording bytes.Buffer
+    recorder, err := NewRecorder(&recording, AsciicastHeader{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    w := recorder.Wrap(nil)
+    // the stream ends in the middle of a rune
+    data := []byte("中文")
+    _, _ = w.Write(data[:4])
+    if err := recorder.Flush(); err != nil {
+        t.Fatal(err)
+    }
+
+    var played bytes.Buffer
+    if _, err := (&Player{MaxIdle: time.Millisecond}).Play(context.Background(), &recording, &played); err != nil {
+        t.Fatal(err)
+    }
+    if played.String() != "中\uFFFD" {
+        t.Errorf("expect %q, got %q", "中\uFFFD", played.String())
+    }
+}
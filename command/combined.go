@@ -0,0 +1,144 @@
+package command
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "sync"
+    "time"
+
+    "github.com/gaodb1210/go-common/util/unit"
+)
+
+const (
+    // StreamStdout tags the output chunks of stdout
+    StreamStdout = "stdout"
+    // StreamStderr tags the output chunks of stderr
+    StreamStderr = "stderr"
+)
+
+// OutputChunk is a piece of the output of one stream, the chunks are kept in arrival order.
+// Data holds at most one line, it ends with a newline unless the line goes on in a later chunk,
+// for example after a chunk of the other stream.
+type OutputChunk struct {
+    Stream string `json:"stream"`
+    // Time is the arrival of the first byte of the chunk since the capture was created, by the monotonic clock
+    Time time.Duration `json:"time"`
+    Data string `json:"data"`
+}
+
+// CombinedOutput captures stdout and stderr of a command in arrival order.
+// Pass Stdout() and Stderr() as the output writers of SyncRun, Run or Start.
+type CombinedOutput struct {
+    mu sync.Mutex
+    start time.Time
+    maxSize int
+    size int
+    chunks []*combinedChunk
+    stdout *combinedWriter
+    stderr *combinedWriter
+}
+
+type combinedChunk struct {
+    stream string
+    time time.Duration
+    data []byte
+}
+
+// NewCombinedOutput creates a CombinedOutput which keeps up to maxSize bytes, dropping the oldest chunks,
+// zero means no limit
+func NewCombinedOutput(maxSize unit.Bytes) *CombinedOutput {
+    c := &CombinedOutput{start: time.Now(), maxSize: int(maxSize)}
+    c.stdout = &combinedWriter{output: c, stream: StreamStdout}
+    c.stderr = &combinedWriter{output: c, stream: StreamStderr}
+    return c
+}
+
+// Stdout returns the writer for stdout
+func (c *CombinedOutput) Stdout() io.Writer {
+    return c.stdout
+}
+
+// Stderr returns the writer for stderr
+func (c *CombinedOutput) Stderr() io.Writer {
+    return c.stderr
+}
+
+// Chunks returns the captured chunks in arrival order
+func (c *CombinedOutput) Chunks() []OutputChunk {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    chunks := make([]OutputChunk, 0, len(c.chunks))
+    for _, chunk := range c.chunks {
+        chunks = append(chunks, OutputChunk{Stream: chunk.stream, Time: chunk.time, Data: string(chunk.data)})
+    }
+    return chunks
+}
+
+// String returns the merged output as a plain log
+func (c *CombinedOutput) String() string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    var data []byte
+    for _, chunk := range c.chunks {
+        data = append(data, chunk.data...)
+    }
+    return string(data)
+}
+
+// WriteTo writes the merged output as a plain log
+func (c *CombinedOutput) WriteTo(w io.Writer) (int64, error) {
+    n, err := io.WriteString(w, c.String())
+    return int64(n), err
+}
+
+// WriteJSON writes every captured chunk as a JSON line of OutputChunk
+func (c *CombinedOutput) WriteJSON(w io.Writer) error {
+    encoder := json.NewEncoder(w)
+    for _, chunk := range c.Chunks() {
+        if err := encoder.Encode(chunk); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// write appends p to the last chunk while it is an open line of the same stream,
+// otherwise p is split into new chunks of one line at most
+func (c *CombinedOutput) write(w *combinedWriter, p []byte) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    now := time.Since(c.start)
+    for len(p) > 0 {
+        n := len(p)
+        if i := bytes.IndexByte(p, '\n'); i >= 0 {
+            n = i + 1
+        }
+        var last *combinedChunk
+        if len(c.chunks) > 0 {
+            last = c.chunks[len(c.chunks)-1]
+        }
+        if last == nil || last.stream != w.stream || last.data[len(last.data)-1] == '\n' {
+            last = &combinedChunk{stream: w.stream, time: now}
+            c.chunks = append(c.chunks, last)
+        }
+        last.data = append(last.data, p[:n]...)
+        c.size += n
+        p = p[n:]
+    }
+    for c.maxSize > 0 && c.size > c.maxSize && len(c.chunks) > 0 {
+        c.size -= len(c.chunks[0].data)
+        c.chunks[0] = nil
+        c.chunks = c.chunks[1:]
+    }
+}
+
+type combinedWriter struct {
+    output *CombinedOutput
+    stream string
+}
+
+func (w *combinedWriter) Write(p []byte) (int, error) {
+    w.output.write(w, p)
+    return len(p), nil
+}
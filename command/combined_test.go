@@ -0,0 +1,60 @@
+package command
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestCombinedOutput_Order(t *testing.T) {
+    c := NewCombinedOutput(0)
+    r := newRunner()
+    _, err := r.Run(context.Background(), Spec{
+        Name: "sh",
+        Args: []string{"-c", "echo one; sleep 0.1; printf 'bad ' >&2; sleep 0.1; echo two; sleep 0.1; echo input >&2; sleep 0.1; printf three"},
+        Stdout: c.Stdout(),
+        Stderr: c.Stderr(),
+        Timeout: 3 * time.Second,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    // the output is kept in arrival order, a line of stderr is split by a line of stdout
+    if c.String() != "one\nbad two\ninput\nthree" {
+        t.Errorf("unexpected merged output %q", c.String())
+    }
+    var b bytes.Buffer
+    if err := c.WriteJSON(&b); err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+    if len(lines) != 5 {
+        t.Fatalf("expect 5 JSON lines, got %q", b.String())
+    }
+    var chunk OutputChunk
+    if err := json.Unmarshal([]byte(lines[1]), &chunk); err != nil {
+        t.Fatal(err)
+    }
+    if chunk.Stream != StreamStderr || chunk.Data != "bad " || chunk.Time < 100*time.Millisecond {
+        t.Errorf("unexpected chunk %+v", chunk)
+    }
+    if err := json.Unmarshal([]byte(lines[3]), &chunk); err != nil {
+        t.Fatal(err)
+    }
+    if chunk.Stream != StreamStderr || chunk.Data != "input\n" || chunk.Time < 300*time.Millisecond {
+        t.Errorf("unexpected chunk %+v", chunk)
+    }
+}
+
+func TestCombinedOutput_MaxSize(t *testing.T) {
+    c := NewCombinedOutput(10)
+    _, _ = c.Stdout().Write([]byte("1234\n5678\n"))
+    _, _ = c.Stderr().Write([]byte("abc"))
+    _, _ = c.Stderr().Write([]byte("\n"))
+    if c.String() != "5678\nabc\n" {
+        t.Errorf("unexpected output %q", c.String())
+    }
+}
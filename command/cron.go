@@ -0,0 +1,234 @@
+package command
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// CronSchedule returns the next activation time after a given time
+type CronSchedule interface {
+    Next(t time.Time) time.Time
+}
+
+type cronField struct {
+    min, max uint
+    names map[string]uint
+}
+
+var (
+    secondField = cronField{0, 59, nil}
+    minuteField = cronField{0, 59, nil}
+    hourField = cronField{0, 23, nil}
+    domField = cronField{1, 31, nil}
+    monthField = cronField{1, 12, map[string]uint{
+        "jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+        "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+    }}
+    // 7 is also sunday, it is folded into 0 after the field is expanded
+    dowField = cronField{0, 7, map[string]uint{
+        "sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+    }}
+
+    cronDescriptors = map[string]string{
+        "@yearly": "0 0 0 1 1 *",
+        "@annually": "0 0 0 1 1 *",
+        "@monthly": "0 0 0 1 * *",
+        "@weekly": "0 0 0 * * 0",
+        "@daily": "0 0 0 * * *",
+        "@midnight": "0 0 0 * * *",
+        "@hourly": "0 0 * * * *",
+    }
+)
+
+// starBit marks a field written as * or ?, used to combine day of month and day of week
+const starBit = 1 << 63
+
+// ParseCron parses a standard cron expression with 5 fields (minute hour dom month dow),
+// or 6 fields with a leading second, or a descriptor like @daily and @every 5m.
+// The expression may start with CRON_TZ=<zone> or TZ=<zone>, otherwise it uses loc.
+func ParseCron(expr string, loc *time.Location) (CronSchedule, error) {
+    if loc == nil {
+        loc = time.Local
+    }
+    expr = strings.TrimSpace(expr)
+    // 1. time zone
+    if strings.HasPrefix(expr, "CRON_TZ=") || strings.HasPrefix(expr, "TZ=") {
+        i := strings.IndexAny(expr, " \t")
+        if i < 0 {
+            return nil, fmt.Errorf("parse cron %q: missing fields after time zone", expr)
+        }
+        zone := expr[strings.Index(expr, "=")+1 : i]
+        var err error
+        if loc, err = time.LoadLocation(zone); err != nil {
+            return nil, fmt.Errorf("parse cron %q: %v", expr, err)
+        }
+        expr = strings.TrimSpace(expr[i:])
+    }
+    // 2. descriptors
+    if strings.HasPrefix(expr, "@every ") {
+        d, err := time.ParseDuration(strings.TrimSpace(expr[len("@every "):]))
+        if err != nil || d <= 0 {
+            return nil, fmt.Errorf("parse cron %q: invalid duration", expr)
+        }
+        return everySchedule{d}, nil
+    }
+    if strings.HasPrefix(expr, "@") {
+        fields, ok := cronDescriptors[strings.ToLower(expr)]
+        if !ok {
+            return nil, fmt.Errorf("parse cron %q: unknown descriptor", expr)
+        }
+        expr = fields
+    }
+    // 3. fields
+    fields := strings.Fields(expr)
+    switch len(fields) {
+    case 5:
+        fields = append([]string{"0"}, fields...)
+    case 6:
+    default:
+        return nil, fmt.Errorf("parse cron %q: expect 5 or 6 fields, got %d", expr, len(fields))
+    }
+    schedule := &cronSpec{location: loc}
+    var err error
+    for i, target := range []*uint64{&schedule.second, &schedule.minute, &schedule.hour, &schedule.dom, &schedule.month, &schedule.dow} {
+        field := []cronField{secondField, minuteField, hourField, domField, monthField, dowField}[i]
+        if *target, err = parseCronField(fields[i], field); err != nil {
+            return nil, fmt.Errorf("parse cron %q: %v", expr, err)
+        }
+    }
+    if schedule.dow&(1<<7) != 0 {
+        schedule.dow = schedule.dow&^(1<<7) | 1
+    }
+    return schedule, nil
+}
+
+// parseCronField parses a comma separated list of *, ?, values, ranges and steps into a bit set
+func parseCronField(value string, field cronField) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(value, ",") {
+        rangeAndStep := strings.SplitN(part, "/", 2)
+        start, end, step := field.min, field.max, uint(1)
+        var extra uint64
+        switch lowAndHigh := strings.SplitN(rangeAndStep[0], "-", 2); {
+        case lowAndHigh[0] == "*" || lowAndHigh[0] == "?":
+            if len(lowAndHigh) > 1 {
+                return 0, fmt.Errorf("invalid range %q", part)
+            }
+            extra = starBit
+        default:
+            var err error
+            if start, err = parseCronValue(lowAndHigh[0], field); err != nil {
+                return 0, err
+            }
+            end = start
+            if len(lowAndHigh) > 1 {
+                if end, err = parseCronValue(lowAndHigh[1], field); err != nil {
+                    return 0, err
+                }
+            } else if len(rangeAndStep) > 1 {
+                // 5/10 means 5-max/10
+                end = field.max
+            }
+        }
+        if len(rangeAndStep) > 1 {
+            n, err := strconv.ParseUint(rangeAndStep[1], 10, 8)
+            if err != nil || n == 0 {
+                return 0, fmt.Errorf("invalid step %q", part)
+            }
+            step = uint(n)
+            extra = 0
+        }
+        if start > end {
+            return 0, fmt.Errorf("invalid range %q", part)
+        }
+        for i := start; i <= end; i += step {
+            bits |= 1 << i
+        }
+        bits |= extra
+    }
+    return bits, nil
+}
+
+func parseCronValue(value string, field cronField) (uint, error) {
+    if n, ok := field.names[strings.ToLower(value)]; ok {
+        return n, nil
+    }
+    n, err := strconv.ParseUint(value, 10, 8)
+    if err != nil {
+        return 0, fmt.Errorf("invalid value %q", value)
+    }
+    if uint(n) < field.min || uint(n) > field.max {
+        return 0, fmt.Errorf("value %q out of range [%d, %d]", value, field.min, field.max)
+    }
+    return uint(n), nil
+}
+
+// everySchedule activates at a fixed interval
+type everySchedule struct {
+    interval time.Duration
+}
+
+func (s everySchedule) Next(t time.Time) time.Time {
+    return t.Add(s.interval)
+}
+
+// cronSpec activates when all fields match, every field is a bit set
+type cronSpec struct {
+    second, minute, hour, dom, month, dow uint64
+    location *time.Location
+}
+
+// Next returns the first matching time after t, or the zero time if nothing matches within 5 years
+func (s *cronSpec) Next(t time.Time) time.Time {
+    origin := t.Location()
+    t = t.In(s.location).Add(time.Second - time.Duration(t.Nanosecond()))
+    yearLimit := t.Year() + 5
+
+wrap:
+    if t.Year() > yearLimit {
+        return time.Time{}
+    }
+    for 1<<uint(t.Month())&s.month == 0 {
+        t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.location)
+        if t.Month() == time.January {
+            goto wrap
+        }
+    }
+    for !s.dayMatches(t) {
+        t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.location)
+        if t.Day() == 1 {
+            goto wrap
+        }
+    }
+    for 1<<uint(t.Hour())&s.hour == 0 {
+        t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.location)
+        if t.Hour() == 0 {
+            goto wrap
+        }
+    }
+    for 1<<uint(t.Minute())&s.minute == 0 {
+        t = t.Truncate(time.Minute).Add(time.Minute)
+        if t.Minute() == 0 {
+            goto wrap
+        }
+    }
+    for 1<<uint(t.Second())&s.second == 0 {
+        t = t.Truncate(time.Second).Add(time.Second)
+        if t.Second() == 0 {
+            goto wrap
+        }
+    }
+    return t.In(origin)
+}
+
+// dayMatches checks day of month and day of week, when both are restricted either one matches
+func (s *cronSpec) dayMatches(t time.Time) bool {
+    domMatch := 1<<uint(t.Day())&s.dom > 0
+    dowMatch := 1<<uint(t.Weekday())&s.dow > 0
+    if s.dom&starBit > 0 || s.dow&starBit > 0 {
+        return domMatch && dowMatch
+    }
+    return domMatch || dowMatch
+}
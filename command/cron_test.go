@@ -0,0 +1,125 @@
+package command
+
+import (
+    "context"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestParseCron_Next(t *testing.T) {
+    shanghai, err := time.LoadLocation("Asia/Shanghai")
+    if err != nil {
+        t.Skip("time zone database is not available")
+    }
+    from := time.Date(2023, 5, 5, 10, 30, 15, 0, time.UTC)
+    cases := []struct {
+        expr string
+        expected time.Time
+    }{
+        {"*/15 * * * *", time.Date(2023, 5, 5, 10, 45, 0, 0, time.UTC)},
+        {"30 */10 * * * *", time.Date(2023, 5, 5, 10, 30, 30, 0, time.UTC)},
+        {"0 9 * * mon-fri", time.Date(2023, 5, 8, 9, 0, 0, 0, time.UTC)},
+        {"0 0 1,15 * *", time.Date(2023, 5, 15, 0, 0, 0, 0, time.UTC)},
+        {"0 0 13 * 5", time.Date(2023, 5, 12, 0, 0, 0, 0, time.UTC)},
+        {"0 0 * * 6-7", time.Date(2023, 5, 6, 0, 0, 0, 0, time.UTC)},
+        {"0 0 * * 7", time.Date(2023, 5, 7, 0, 0, 0, 0, time.UTC)},
+        {"0 0 * * 1-7/3", time.Date(2023, 5, 7, 0, 0, 0, 0, time.UTC)},
+        {"@monthly", time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)},
+        {"@every 5m", from.Add(5 * time.Minute)},
+        {"CRON_TZ=Asia/Shanghai 0 8 * * *", time.Date(2023, 5, 6, 8, 0, 0, 0, shanghai)},
+    }
+    for _, c := range cases {
+        schedule, err := ParseCron(c.expr, time.UTC)
+        if err != nil {
+            t.Errorf("parse %q error: %v", c.expr, err)
+            continue
+        }
+        if next := schedule.Next(from); !next.Equal(c.expected) {
+            t.Errorf("%q: expect next %s, got %s", c.expr, c.expected, next)
+        }
+    }
+    for _, expr := range []string{"* * * *", "60 * * * *", "* * * * 8", "@every -1s", "@fortnightly"} {
+        if _, err := ParseCron(expr, time.UTC); err == nil {
+            t.Errorf("parse %q should fail", expr)
+        }
+    }
+}
+
+func TestScheduler_CatchUpAndHistory(t *testing.T) {
+    dir, err := ioutil.TempDir("", "scheduler")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    s := NewScheduler(newRunner(), time.UTC)
+    // the last activation is long ago, so one activation is missed
+    s.recordActivation("echo", time.Now().Add(-time.Hour))
+    if err := s.SetStateFile(filepath.Join(dir, "state.json")); err != nil {
+        t.Fatal(err)
+    }
+    err = s.Add(CronJob{
+        Name: "echo",
+        Schedule: "@every 200ms",
+        Spec: Spec{Name: "echo", Args: []string{"hello"}},
+        CatchUp: CatchUpOnce,
+        HistorySize: 2,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.Start()
+    time.Sleep(700 * time.Millisecond)
+    s.Stop()
+
+    history, err := s.History("echo")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(history) != 2 {
+        t.Fatalf("expect 2 runs in history, got %d", len(history))
+    }
+    for _, run := range history {
+        if run.Err != nil && run.Err != context.Canceled {
+            t.Errorf("run at %s error: %v", run.Scheduled, run.Err)
+        }
+    }
+    if _, err := os.Stat(filepath.Join(dir, "state.json")); err != nil {
+        t.Errorf("state file is not written: %v", err)
+    }
+}
+
+func TestScheduler_CatchUpAll(t *testing.T) {
+    s := NewScheduler(newRunner(), time.UTC)
+    last := time.Now().Add(-time.Second)
+    s.recordActivation("echo", last)
+    err := s.Add(CronJob{
+        Name: "echo",
+        Schedule: "@every 300ms",
+        Spec: Spec{Name: "echo", Args: []string{"hello"}},
+        Overlap: OverlapQueue,
+        CatchUp: CatchUpAll,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    s.Start()
+    time.Sleep(200 * time.Millisecond)
+    s.Stop()
+
+    history, err := s.History("echo")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(history) != 3 {
+        t.Fatalf("expect 3 missed runs, got %d", len(history))
+    }
+    for i, run := range history {
+        if expected := last.Add(time.Duration(i+1) * 300 * time.Millisecond); !run.Scheduled.Equal(expected) || run.Err != nil {
+            t.Errorf("run %d: expect activation at %s, got %s, error %v", i, expected, run.Scheduled, run.Err)
+        }
+    }
+}
@@ -0,0 +1,489 @@
+package command
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "os/exec"
+    "sync"
+    "syscall"
+    "time"
+
+    "github.com/gaodb1210/go-common/util/unit"
+)
+
+const (
+    // StateRunning -- the command is running
+    StateRunning int = iota
+    // StatePaused -- the command process group is stopped by SIGSTOP
+    StatePaused
+    // StateExited -- the command exited or was killed
+    StateExited
+)
+
+var (
+    ErrNotRunning = errors.New("command is not running")
+    ErrNotPaused = errors.New("command is not paused")
+)
+
+// Execution is the handle of a started command
+type Execution struct {
+    runner *Runner
+    spec Spec
+    name string
+    cmd *exec.Cmd
+    cancel context.CancelFunc
+    finished chan WaitProcessResult
+    activity *outputActivity
+    limiter *outputLimiter
+    redactWriters []*redactWriter
+    tail *tailWriter
+    pipes *outputPipes
+    logs *logFiles
+    privateTmp string
+    started bool
+
+    mu sync.Mutex
+    state int
+    pausedAt time.Time
+    stateChanged chan struct{}
+
+    result *Result
+    err error
+    done chan struct{}
+}
+
+// Start starts the command described by spec once without retry, and returns the handle of the running command
+func (r *Runner) Start(ctx context.Context, spec Spec) (*Execution, error) {
+    e, err := r.start(ctx, spec)
+    if err != nil {
+        return nil, r.secrets.maskError(err)
+    }
+    return e, nil
+}
+
+// start starts the command, the returned execution holds the result even if it fails to start
+func (r *Runner) start(ctx context.Context, spec Spec) (*Execution, error) {
+    name := r.secrets.String(spec.Name)
+    e := &Execution{
+        runner: r,
+        spec: spec,
+        name: name,
+        stateChanged: make(chan struct{}, 1),
+        done: make(chan struct{}),
+        result: &Result{
+            Name: name,
+            Args: r.secrets.Strings(spec.Args),
+            Env: r.secrets.Strings(spec.Env),
+            Status: Success,
+        },
+    }
+    // 1. init command
+    if err := r.checkPolicy(spec); err != nil {
+        e.result.ExitCode = 1
+        e.result.Status = Fail
+        e.closeLogs()
+        e.record(err)
+        return e, err
+    }
+    stdoutWriter, stderrWriter := spec.Stdout, spec.Stderr
+    if spec.Log != nil {
+        var stdoutLog, stderrLog io.Writer
+        e.logs, stdoutLog, stderrLog = openLogFiles(spec.Log)
+        stdoutWriter, stderrWriter = teeOutput(stdoutLog, stderrLog, stdoutWriter, stderrWriter)
+    }
+    if r.outputLimit.enabled() {
+        e.limiter = newOutputLimiter(r.outputLimit)
+        stdoutWriter = e.limiter.wrap(stdoutWriter, r.outputLimit.Stdout)
+        stderrWriter = e.limiter.wrap(stderrWriter, r.outputLimit.Stderr)
+    }
+    if tailSize := r.tailSize(); tailSize > 0 {
+        e.tail = newTailWriter(tailSize)
+        stdoutWriter, stderrWriter = wrapOutput(stdoutWriter, stderrWriter, e.tail.tee)
+    }
+    if r.secrets.enabled() {
+        stdoutWriter, stderrWriter = wrapOutput(stdoutWriter, stderrWriter, func(w io.Writer) io.Writer {
+            if w == nil {
+                return nil
+            }
+            redactWriter := r.secrets.wrap(w)
+            e.redactWriters = append(e.redactWriters, redactWriter)
+            return redactWriter
+        })
+    }
+    if r.idleTimeout > 0 {
+        e.activity = newOutputActivity(r.heartbeatFile)
+        stdoutWriter, stderrWriter = wrapOutput(stdoutWriter, stderrWriter, e.activity.wrap)
+    }
+    privateTmp, err := r.prepareDir(spec.Dir)
+    if err != nil {
+        fmt.Printf("prepare command dir fail: %s\n", r.secrets.String(err.Error()))
+        e.result.ExitCode = 1
+        e.result.Status = Fail
+        e.closeLogs()
+        e.record(err)
+        return e, err
+    }
+    e.privateTmp = privateTmp
+    e.cmd = exec.Command(spec.Name, spec.Args...)
+    e.cmd.Dir = spec.Dir
+    e.cmd.Env = spec.Env
+    if err := r.preProcess(e.cmd); err != nil {
+        r.removePrivateTmp(e.privateTmp)
+        e.result.Status = Fail
+        e.closeLogs()
+        e.record(err)
+        return e, err
+    }
+    if e.privateTmp != "" {
+        e.cmd.Env = append(e.cmd.Env, "TMPDIR="+e.privateTmp)
+    }
+    if e.pipes, err = newOutputPipes(e.cmd, stdoutWriter, stderrWriter); err != nil {
+        r.removePrivateTmp(e.privateTmp)
+        e.result.Status = Fail
+        e.closeLogs()
+        e.record(err)
+        return e, err
+    }
+
+    // 2. start command
+    e.result.StartTime = time.Now()
+    if err := r.startCommand(e.cmd); err != nil {
+        e.pipes.close()
+        r.removePrivateTmp(e.privateTmp)
+        fmt.Printf("start command %s fail: %s\n", r.secrets.redactArgs(spec.Name, spec.Args), r.secrets.String(err.Error()))
+        e.result.EndTime = time.Now()
+        e.result.ExitCode = 1
+        e.result.Status = Fail
+        e.closeLogs()
+        e.record(err)
+        return e, err
+    }
+    e.pipes.started()
+    e.started = true
+    if r.metrics != nil {
+        r.metrics.CommandStarted(e.name)
+    }
+    // 3. start goroutine to wait finish
+    e.finished = make(chan WaitProcessResult, 1)
+    go func() {
+        processState, err := e.cmd.Process.Wait()
+        e.finished <- WaitProcessResult{
+            processState: processState,
+            err: err,
+        }
+    }()
+    if r.forwarder != nil {
+        r.forwarder.register(e)
+    }
+    ctx, e.cancel = context.WithCancel(ctx)
+    r.addRun(e.cmd, e.cancel)
+    go e.wait(ctx)
+    return e, nil
+}
+
+// Pid returns the process id of the command, which is also its process group id
+func (e *Execution) Pid() int {
+    return e.cmd.Process.Pid
+}
+
+// State returns one of StateRunning, StatePaused and StateExited
+func (e *Execution) State() int {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    return e.state
+}
+
+// Pause stops the whole process group with SIGSTOP, the paused time does not count for the timeout
+func (e *Execution) Pause() error {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if e.state != StateRunning {
+        return ErrNotRunning
+    }
+    if err := signalProcessGroup(e.cmd, syscall.SIGSTOP); err != nil {
+        return err
+    }
+    e.state = StatePaused
+    e.pausedAt = time.Now()
+    e.notifyStateChanged()
+    return nil
+}
+
+// Resume continues the paused process group with SIGCONT
+func (e *Execution) Resume() error {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if e.state != StatePaused {
+        return ErrNotPaused
+    }
+    if err := signalProcessGroup(e.cmd, syscall.SIGCONT); err != nil {
+        return err
+    }
+    e.state = StateRunning
+    e.result.PausedTime += time.Since(e.pausedAt)
+    e.notifyStateChanged()
+    return nil
+}
+
+// Signal sends sig to the process group of the command
+func (e *Execution) Signal(sig syscall.Signal) error {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if e.state == StateExited {
+        return ErrNotRunning
+    }
+    return signalProcessGroup(e.cmd, sig)
+}
+
+// LogPaths returns the current log files of Spec.Log followed by their rotated files
+func (e *Execution) LogPaths() []string {
+    if e.logs == nil {
+        return nil
+    }
+    return e.logs.paths()
+}
+
+// closeLogs closes the log files of Spec.Log
+func (e *Execution) closeLogs() {
+    if e.logs == nil {
+        return
+    }
+    if err := e.logs.close(); err != nil {
+        fmt.Printf("close command: %s log files error: %v\n", e.name, err)
+    }
+}
+
+// Cancel stops the command like its context is done
+func (e *Execution) Cancel() {
+    e.cancel()
+}
+
+// Done returns a channel which is closed when the command finishes
+func (e *Execution) Done() <-chan struct{} {
+    return e.done
+}
+
+// Wait waits for the command to finish and returns its result
+func (e *Execution) Wait() (*Result, error) {
+    <-e.done
+    return e.result, e.err
+}
+
+// notifyStateChanged wakes up the wait loop, e.mu must be held
+func (e *Execution) notifyStateChanged() {
+    select {
+    case e.stateChanged <- struct{}{}:
+    default:
+    }
+}
+
+// timeoutRemaining returns the time left before Spec.Timeout, the paused time does not count,
+// and whether the command is paused
+func (e *Execution) timeoutRemaining(now time.Time) (time.Duration, bool) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    paused := e.result.PausedTime
+    if e.state == StatePaused {
+        paused += now.Sub(e.pausedAt)
+    }
+    return e.spec.Timeout - (now.Sub(e.result.StartTime) - paused), e.state == StatePaused
+}
+
+// wait waits until the command finishes, times out, idle times out or ctx is done
+func (e *Execution) wait(ctx context.Context) {
+    defer close(e.done)
+    defer e.cancel()
+    r, spec, result, name := e.runner, e.spec, e.result, e.name
+    var err error
+
+    var timer *time.Timer
+    var timeoutC <-chan time.Time
+    if spec.Timeout > 0 {
+        timer = time.NewTimer(spec.Timeout)
+        defer timer.Stop()
+        timeoutC = timer.C
+    }
+    var idleC <-chan time.Time
+    if e.activity != nil {
+        ticker := time.NewTicker(idleCheckInterval(r.idleTimeout))
+        defer ticker.Stop()
+        idleC = ticker.C
+    }
+    var exceededC <-chan struct{}
+    if e.limiter != nil && r.outputLimit.KillOnExceed {
+        exceededC = e.limiter.exceeded
+    }
+    // 4. wait command execute finish, timeout, idle timeout or cancel
+wait:
+    for {
+        select {
+        case waitProcessResult := <-e.finished:
+            fmt.Printf("Command: %s execute completed\n", name)
+            if waitProcessResult.processState == nil {
+                result.ExitCode = 1
+                result.Status = Fail
+                err = waitProcessResult.err
+                break wait
+            }
+            if waitProcessResult.err != nil {
+                fmt.Printf("os.Process.Wait() returns error with valid process state\n")
+            }
+            result.ExitCode = waitProcessResult.processState.ExitCode()
+            result.processState = waitProcessResult.processState
+            result.Usage = resourceUsage(waitProcessResult.processState)
+            break wait
+        case <-e.stateChanged:
+            // exclude the paused time from the timeout, notifications may collapse, so check the state
+            remaining, paused := e.timeoutRemaining(time.Now())
+            if timer != nil {
+                if !timer.Stop() {
+                    select {
+                    case <-timer.C:
+                    default:
+                    }
+                }
+                if !paused {
+                    timer.Reset(remaining)
+                }
+            }
+            if !paused && e.activity != nil {
+                e.activity.touch()
+            }
+        case <-timeoutC:
+            // the command may be paused or resumed just before the timer fires
+            if remaining, paused := e.timeoutRemaining(time.Now()); paused || remaining > 0 {
+                if !paused {
+                    timer.Reset(remaining)
+                }
+                continue
+            }
+            fmt.Printf("command: %s execute timeout", name)
+            result.ExitCode = 1
+            result.Status = Timeout
+            err = ErrCommandTimeout
+            _ = killProcessGroup(e.cmd)
+            break wait
+        case <-ctx.Done():
+            fmt.Printf("command: %s execute canceled", name)
+            result.ExitCode = 1
+            result.Status = Canceled
+            err = ctx.Err()
+            e.stop(spec.StopTimeout)
+            break wait
+        case now := <-idleC:
+            if e.State() == StatePaused || e.activity.idleFor(now) < r.idleTimeout {
+                continue
+            }
+            fmt.Printf("command: %s has no output for %s, execute idle timeout", name, r.idleTimeout)
+            result.ExitCode = 1
+            result.Status = IdleTimeout
+            err = ErrCommandIdleTimeout
+            _ = killProcessGroup(e.cmd)
+            break wait
+        case <-exceededC:
+            fmt.Printf("command: %s output exceeds the limit", name)
+            result.ExitCode = 1
+            result.Status = OutputLimitExceeded
+            err = ErrOutputLimitExceeded
+            _ = killProcessGroup(e.cmd)
+            break wait
+        }
+    }
+    // 5. finish
+    // allow remaining data to be copied back
+    e.pipes.wait(outputCopyDelay)
+    r.removeRun(e.cmd)
+    if r.forwarder != nil {
+        r.forwarder.unregister(e)
+    }
+    e.mu.Lock()
+    if e.state == StatePaused {
+        result.PausedTime += time.Since(e.pausedAt)
+    }
+    e.state = StateExited
+    e.mu.Unlock()
+    for _, w := range e.redactWriters {
+        if flushErr := w.flush(); flushErr != nil && err == nil {
+            err = flushErr
+        }
+    }
+    if e.limiter != nil {
+        if flushErr := e.limiter.flush(); flushErr != nil && err == nil {
+            err = flushErr
+        }
+    }
+    e.closeLogs()
+    result.EndTime = time.Now()
+    if e.tail != nil {
+        result.OutputTail = e.tail.String()
+    }
+    
+    if r.user != "" {
+        _ = r.removeCredential()
+    }
+    r.removePrivateTmp(e.privateTmp)
+    e.err = r.secrets.maskError(err)
+    e.record(err)
+}
+
+// record reports the result to the metrics and appends it to the history store of the runner
+func (e *Execution) record(err error) {
+    r := e.runner
+    if r.metrics != nil && e.started {
+        r.metrics.CommandFinished(e.name, e.result.Status, e.result.ExitCode, e.result.Duration(), e.result.Usage.MaxRSS)
+    } else if r.metrics != nil {
+        r.metrics.CommandStartFailed(e.name)
+    }
+    if r.history == nil {
+        return
+    }
+    record := HistoryRecord{
+        Command: e.result.Name,
+        Args: e.result.Args,
+        User: r.user,
+        Dir: e.spec.Dir,
+        StartTime: e.result.StartTime,
+        EndTime: e.result.EndTime,
+        ExitCode: e.result.ExitCode,
+        Status: e.result.Status,
+        Usage: e.result.Usage,
+        OutputTail: e.result.OutputTail,
+    }
+    if err != nil {
+        record.Error = r.secrets.String(err.Error())
+    }
+    if appendErr := r.history.Append(record); appendErr != nil {
+        fmt.Printf("record command: %s history error: %v\n", e.name, appendErr)
+    }
+}
+
+// tailSize returns the size of the output tail to keep for the result and the history
+func (r *Runner) tailSize() unit.Bytes {
+    size := r.outputTailSize
+    if r.history != nil && r.history.options.TailSize > size {
+        size = r.history.options.TailSize
+    }
+    return size
+}
+
+// stop sends SIGTERM to the process group, and kills it if it does not exit within stopTimeout
+func (e *Execution) stop(stopTimeout time.Duration) {
+    if stopTimeout <= 0 {
+        _ = killProcessGroup(e.cmd)
+        return
+    }
+    _ = signalProcessGroup(e.cmd, syscall.SIGTERM)
+    // a paused process handles SIGTERM only after it continues
+    _ = signalProcessGroup(e.cmd, syscall.SIGCONT)
+    timer := time.NewTimer(stopTimeout)
+    defer timer.Stop()
+    select {
+    case <-e.finished:
+    case <-timer.C:
+        fmt.Printf("command: pid %d does not exit within %s after SIGTERM, kill it\n", e.Pid(), stopTimeout)
+    }
+    // kill the rest of the process group anyway
+    _ = killProcessGroup(e.cmd)
+}
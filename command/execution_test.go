@@ -0,0 +1,76 @@
+package command
+
+import (
+    "bytes"
+    "context"
+    "testing"
+    "time"
+)
+
+func TestExecution_PauseResume(t *testing.T) {
+    r := newRunner()
+    output := bytes.NewBufferString("")
+    e, err := r.Start(context.Background(), Spec{
+        Name: "sh",
+        Args: []string{"-c", "sleep 0.5; echo done"},
+        Stdout: output,
+        Timeout: time.Second,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := e.Resume(); err != ErrNotPaused {
+        t.Errorf("expect ErrNotPaused, got %v", err)
+    }
+    if err := e.Pause(); err != nil {
+        t.Fatal(err)
+    }
+    if e.State() != StatePaused {
+        t.Errorf("expect paused state, got %d", e.State())
+    }
+    // paused longer than the timeout
+    time.Sleep(1200 * time.Millisecond)
+    if err := e.Resume(); err != nil {
+        t.Fatal(err)
+    }
+    result, err := e.Wait()
+    if err != nil || result.Status != Success {
+        t.Fatalf("expect success, got status %d err %v", result.Status, err)
+    }
+    if result.PausedTime < time.Second || output.String() != "done\n" {
+        t.Errorf("unexpected paused time %s output %q", result.PausedTime, output.String())
+    }
+    if e.State() != StateExited {
+        t.Errorf("expect exited state, got %d", e.State())
+    }
+}
+
+func TestExecution_PauseResumeTimeout(t *testing.T) {
+    r := newRunner()
+    e, err := r.Start(context.Background(), Spec{
+        Name: "sleep",
+        Args: []string{"5"},
+        Timeout: 400 * time.Millisecond,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    // quick pauses do not extend the timeout budget
+    go func() {
+        for e.State() != StateExited {
+            _ = e.Pause()
+            _ = e.Resume()
+            time.Sleep(20 * time.Millisecond)
+        }
+    }()
+    select {
+    case <-e.Done():
+    case <-time.After(2 * time.Second):
+        e.Cancel()
+        t.Fatal("the timeout is extended by quick pauses")
+    }
+    result, err := e.Wait()
+    if err != ErrCommandTimeout || result.Status != Timeout {
+        t.Errorf("expect timeout, got status %d err %v", result.Status, err)
+    }
+}
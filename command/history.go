@@ -0,0 +1,370 @@
+package command
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gaodb1210/go-common/buffer/ringbuffer"
+    "github.com/gaodb1210/go-common/util/fileutil"
+    "github.com/gaodb1210/go-common/util/unit"
+)
+
+const (
+    defaultHistoryMaxSize = 64 * unit.MB
+    defaultHistoryMaxBackups = 10
+    defaultHistoryTailSize = 4 * unit.KB
+    historyFileMode = 0600
+    historyBackupTimeFormat = "20060102T150405.000"
+    historyMaxLineSize = 16 * unit.MB
+)
+
+// ResourceUsage is the resource usage of a command process
+type ResourceUsage struct {
+    UserTime time.Duration `json:"user_time"`
+    SystemTime time.Duration `json:"system_time"`
+    MaxRSS unit.Bytes `json:"max_rss"`
+}
+
+// HistoryRecord records one executed command
+type HistoryRecord struct {
+    Command string `json:"command"`
+    Args []string `json:"args,omitempty"`
+    User string `json:"user,omitempty"`
+    Dir string `json:"dir,omitempty"`
+    StartTime time.Time `json:"start_time"`
+    EndTime time.Time `json:"end_time"`
+    ExitCode int `json:"exit_code"`
+    Status int `json:"status"`
+    Error string `json:"error,omitempty"`
+    Usage ResourceUsage `json:"usage"`
+    OutputTail string `json:"output_tail,omitempty"`
+}
+
+// HistoryOptions configures the rotation of a HistoryStore
+type HistoryOptions struct {
+    // MaxSize rotates the history file when it grows over MaxSize, zero means 64MB
+    MaxSize unit.Bytes
+    // MaxAge rotates the history file when it is older than MaxAge, zero means no age limit
+    MaxAge time.Duration
+    // MaxBackups is the number of rotated files to keep, zero means 10
+    MaxBackups int
+    // TailSize is the size of the output tail kept in every record, zero means 4KB
+    TailSize unit.Bytes
+}
+
+// HistoryFilter selects records in HistoryStore.Query, zero fields match all records
+type HistoryFilter struct {
+    // From and To limit the start time of the command
+    From time.Time
+    To time.Time
+    // Statuses lists the accepted statuses
+    Statuses []int
+    // Command is the accepted command name, matching either the full name or its base name
+    Command string
+}
+
+// historyHeader is the first line of a history file, it records when the file was created for MaxAge
+type historyHeader struct {
+    CreatedAt time.Time `json:"history_created_at"`
+}
+
+// HistoryStore is an append-only JSON lines file of executed commands, rotated by size and age
+type HistoryStore struct {
+    path string
+    options HistoryOptions
+    mu sync.Mutex
+    file *os.File
+    size int64
+    headerSize int64
+    createdAt time.Time
+}
+
+// OpenHistoryStore opens or creates the history file at path
+func OpenHistoryStore(path string, options HistoryOptions) (*HistoryStore, error) {
+    if options.MaxSize <= 0 {
+        options.MaxSize = defaultHistoryMaxSize
+    }
+    if options.MaxBackups <= 0 {
+        options.MaxBackups = defaultHistoryMaxBackups
+    }
+    if options.TailSize <= 0 {
+        options.TailSize = defaultHistoryTailSize
+    }
+    s := &HistoryStore{path: path, options: options}
+    if err := s.open(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+// Append writes a record to the history file, it rotates the file first when needed
+func (s *HistoryStore) Append(record HistoryRecord) error {
+    line, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+    line = append(line, '\n')
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.file == nil {
+        return os.ErrClosed
+    }
+    if s.size > s.headerSize && (s.size+int64(len(line)) > s.options.MaxSize.ToNumber() ||
+        s.options.MaxAge > 0 && time.Since(s.createdAt) > s.options.MaxAge) {
+        if err := s.rotate(); err != nil {
+            return err
+        }
+    }
+    n, err := s.file.Write(line)
+    s.size += int64(n)
+    return err
+}
+
+// Query returns the records matching filter from the rotated and the current files, the oldest first
+func (s *HistoryStore) Query(filter HistoryFilter) ([]HistoryRecord, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    backups, err := s.backups()
+    if err != nil {
+        return nil, err
+    }
+    var records []HistoryRecord
+    for _, name := range append(backups, s.path) {
+        f, err := os.Open(name)
+        if os.IsNotExist(err) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        scanner := bufio.NewScanner(f)
+        scanner.Buffer(nil, int(historyMaxLineSize))
+        for scanner.Scan() {
+            var record HistoryRecord
+            if isHistoryHeader(scanner.Bytes()) || json.Unmarshal(scanner.Bytes(), &record) != nil {
+                // skip the header, and a line broken by a crash
+                continue
+            }
+            if filter.match(&record) {
+                records = append(records, record)
+            }
+        }
+        err = scanner.Err()
+        _ = f.Close()
+        if err != nil {
+            return nil, err
+        }
+    }
+    return records, nil
+}
+
+// Close closes the history file
+func (s *HistoryStore) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.file == nil {
+        return nil
+    }
+    err := s.file.Close()
+    s.file = nil
+    return err
+}
+
+func (s *HistoryStore) open() error {
+    f, err := fileutil.OpenFile(s.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, historyFileMode)
+    if err != nil {
+        return err
+    }
+    info, err := f.Stat()
+    if err != nil {
+        _ = f.Close()
+        return err
+    }
+    s.file = f
+    s.size = info.Size()
+    s.headerSize = 0
+    if s.size == 0 {
+        // a new file records its creation time in the header
+        s.createdAt = time.Now()
+        line, err := json.Marshal(historyHeader{CreatedAt: s.createdAt})
+        if err == nil {
+            var n int
+            n, err = f.Write(append(line, '\n'))
+            s.size += int64(n)
+            s.headerSize = int64(n)
+        }
+        if err != nil {
+            _ = f.Close()
+            s.file = nil
+        }
+        return err
+    }
+    s.createdAt, s.headerSize = readHistoryCreatedAt(f, info)
+    return nil
+}
+
+// readHistoryCreatedAt returns the creation time recorded in the header of f and the header size,
+// a file without the header is created at the start time of its first record
+func readHistoryCreatedAt(f *os.File, info os.FileInfo) (time.Time, int64) {
+    reader := bufio.NewReader(io.NewSectionReader(f, 0, info.Size()))
+    line, err := reader.ReadBytes('\n')
+    if err != nil {
+        return info.ModTime(), 0
+    }
+    var header historyHeader
+    if json.Unmarshal(line, &header) == nil && !header.CreatedAt.IsZero() {
+        return header.CreatedAt, int64(len(line))
+    }
+    var record HistoryRecord
+    if json.Unmarshal(line, &record) == nil && !record.StartTime.IsZero() {
+        return record.StartTime, 0
+    }
+    return info.ModTime(), 0
+}
+
+// isHistoryHeader reports whether line is the header of a history file
+func isHistoryHeader(line []byte) bool {
+    var header historyHeader
+    return bytes.Contains(line, []byte(`"history_created_at"`)) && json.Unmarshal(line, &header) == nil && !header.CreatedAt.IsZero()
+}
+
+// rotate renames the current file with a unique timestamp suffix, removes the oldest backups, and opens a new file
+func (s *HistoryStore) rotate() error {
+    if err := s.file.Close(); err != nil {
+        return err
+    }
+    s.file = nil
+    backup := s.path + "." + time.Now().Format(historyBackupTimeFormat)
+    // two rotations within the same millisecond get a sequence number
+    for seq, name := 1, backup; ; seq++ {
+        if _, err := os.Lstat(name); os.IsNotExist(err) {
+            backup = name
+            break
+        }
+        name = backup + "-" + strconv.Itoa(seq)
+    }
+    if err := os.Rename(s.path, backup); err != nil {
+        return err
+    }
+    backups, err := s.backups()
+    if err != nil {
+        return err
+    }
+    for len(backups) > s.options.MaxBackups {
+        _ = os.Remove(backups[0])
+        backups = backups[1:]
+    }
+    return s.open()
+}
+
+// historyBackup is a rotated file, named by the path, the rotation time and an optional sequence number
+type historyBackup struct {
+    name string
+    rotatedAt time.Time
+    seq int
+}
+
+// backups returns the rotated files, the oldest first, files not named like a backup are ignored
+func (s *HistoryStore) backups() ([]string, error) {
+    names, err := filepath.Glob(s.path + ".*")
+    if err != nil {
+        return nil, err
+    }
+    var backups []historyBackup
+    for _, name := range names {
+        suffix := strings.TrimPrefix(name, s.path+".")
+        backup := historyBackup{name: name}
+        if i := strings.IndexByte(suffix, '-'); i >= 0 {
+            if backup.seq, err = strconv.Atoi(suffix[i+1:]); err != nil || backup.seq <= 0 {
+                continue
+            }
+            suffix = suffix[:i]
+        }
+        if backup.rotatedAt, err = time.ParseInLocation(historyBackupTimeFormat, suffix, time.Local); err != nil {
+            continue
+        }
+        backups = append(backups, backup)
+    }
+    sort.Slice(backups, func(i, j int) bool {
+        if !backups[i].rotatedAt.Equal(backups[j].rotatedAt) {
+            return backups[i].rotatedAt.Before(backups[j].rotatedAt)
+        }
+        return backups[i].seq < backups[j].seq
+    })
+    names = names[:0]
+    for _, backup := range backups {
+        names = append(names, backup.name)
+    }
+    return names, nil
+}
+
+func (f HistoryFilter) match(record *HistoryRecord) bool {
+    if !f.From.IsZero() && record.StartTime.Before(f.From) {
+        return false
+    }
+    if !f.To.IsZero() && record.StartTime.After(f.To) {
+        return false
+    }
+    if f.Command != "" && record.Command != f.Command && filepath.Base(record.Command) != f.Command {
+        return false
+    }
+    if len(f.Statuses) == 0 {
+        return true
+    }
+    for _, status := range f.Statuses {
+        if record.Status == status {
+            return true
+        }
+    }
+    return false
+}
+
+// tailWriter keeps the last bytes written by both streams of a command
+type tailWriter struct {
+    mu sync.Mutex
+    size int
+    buf *ringbuffer.RingBuffer
+}
+
+func newTailWriter(size unit.Bytes) *tailWriter {
+    return &tailWriter{size: int(size), buf: ringbuffer.New(int(size))}
+}
+
+// tee returns a writer which writes to w and keeps the tail, a nil w only keeps the tail
+func (t *tailWriter) tee(w io.Writer) io.Writer {
+    if w == nil {
+        return t
+    }
+    return io.MultiWriter(t, w)
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    n := len(p)
+    if n >= t.size {
+        t.buf.Reset()
+        p = p[n-t.size:]
+    } else if excess := t.buf.Length() + n - t.size; excess > 0 {
+        t.buf.Discard(excess)
+    }
+    _, _ = t.buf.Write(p)
+    return n, nil
+}
+
+// String returns the kept tail
+func (t *tailWriter) String() string {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    head, tail := t.buf.PeekAll()
+    return strings.ToValidUTF8(string(head)+string(tail), "")
+}
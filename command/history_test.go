@@ -0,0 +1,140 @@
+package command
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestHistoryStore_RecordAndQuery(t *testing.T) {
+    dir, err := ioutil.TempDir("", "history")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "history.jsonl")
+    store, err := OpenHistoryStore(path, HistoryOptions{MaxSize: 300, MaxBackups: 5})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+
+    r := newRunner()
+    r.SetHistoryStore(store)
+    r.AddSecret("hunter2")
+    start := time.Now()
+    for _, args := range [][]string{{"-c", "echo one"}, {"-c", "echo hunter2; exit 3"}, {"-c", "echo three"}} {
+        if _, err := r.Run(context.Background(), Spec{Name: "sh", Args: args, Timeout: 2 * time.Second}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    _, _ = r.Run(context.Background(), Spec{Name: "/bin/sleep", Args: []string{"1"}, Timeout: 100 * time.Millisecond})
+
+    records, err := store.Query(HistoryFilter{From: start, Command: "sh"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(records) != 3 {
+        t.Fatalf("expect 3 records, got %d", len(records))
+    }
+    if records[1].ExitCode != 3 || records[1].OutputTail != "******\n" || records[1].Args[1] != "echo ******; exit 3" {
+        t.Errorf("unexpected record: %+v", records[1])
+    }
+    records, err = store.Query(HistoryFilter{Statuses: []int{Timeout}, Command: "sleep"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(records) != 1 || records[0].Error != ErrCommandTimeout.Error() {
+        t.Fatalf("expect 1 timeout record, got %+v", records)
+    }
+    if backups, _ := store.backups(); len(backups) == 0 {
+        t.Error("expect the history file to be rotated")
+    }
+}
+
+func TestHistoryStore_MaxAgeAfterReopen(t *testing.T) {
+    dir, err := ioutil.TempDir("", "history")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    created := time.Now().Add(-2 * time.Hour)
+    header, _ := json.Marshal(historyHeader{CreatedAt: created})
+    record, _ := json.Marshal(HistoryRecord{Command: "old", StartTime: created})
+    for name, content := range map[string][]byte{
+        "header.jsonl": append(append(header, '\n'), append(record, '\n')...),
+        // a file written before the header existed
+        "legacy.jsonl": append(record, '\n'),
+    } {
+        path := filepath.Join(dir, name)
+        if err := ioutil.WriteFile(path, content, 0600); err != nil {
+            t.Fatal(err)
+        }
+        // unrelated files next to the history file
+        for _, other := range []string{path + ".old", path + ".bak-1"} {
+            if err := ioutil.WriteFile(other, nil, 0600); err != nil {
+                t.Fatal(err)
+            }
+        }
+        store, err := OpenHistoryStore(path, HistoryOptions{MaxAge: time.Hour, MaxBackups: 1})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !store.createdAt.Equal(created) {
+            t.Errorf("%s: expect created at %s, got %s", name, created, store.createdAt)
+        }
+        if err := store.Append(HistoryRecord{Command: "new", StartTime: time.Now()}); err != nil {
+            t.Fatal(err)
+        }
+        if backups, _ := store.backups(); len(backups) != 1 {
+            t.Errorf("%s: expect the old file to be rotated, got backups %v", name, backups)
+        }
+        records, err := store.Query(HistoryFilter{})
+        if err != nil || len(records) != 2 || records[0].Command != "old" || records[1].Command != "new" {
+            t.Errorf("%s: unexpected records %+v, error %v", name, records, err)
+        }
+        _ = store.Close()
+        for _, other := range []string{path + ".old", path + ".bak-1"} {
+            if _, err := os.Stat(other); err != nil {
+                t.Errorf("unrelated file is removed: %v", err)
+            }
+        }
+    }
+}
+
+func TestHistoryStore_RotateSameMillisecond(t *testing.T) {
+    dir, err := ioutil.TempDir("", "history")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "history.jsonl")
+    store, err := OpenHistoryStore(path, HistoryOptions{MaxSize: 1, MaxBackups: 10})
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer store.Close()
+    // every append rotates the previous record
+    for i := 0; i < 5; i++ {
+        if err := store.Append(HistoryRecord{Command: strings.Repeat("x", i+1)}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    records, err := store.Query(HistoryFilter{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var commands bytes.Buffer
+    for _, record := range records {
+        commands.WriteString(record.Command + " ")
+    }
+    if commands.String() != "x xx xxx xxxx xxxxx " {
+        t.Errorf("records are lost or out of order: %q", commands.String())
+    }
+}
@@ -0,0 +1,75 @@
+package command
+
+import (
+    "io"
+    "io/ioutil"
+    "os"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    maxIdleCheckInterval = time.Second
+    minIdleCheckInterval = 10 * time.Millisecond
+)
+
+// outputActivity tracks the last time a command produced output or touched its heartbeat file
+type outputActivity struct {
+    lastWrite int64
+    heartbeatFile string
+}
+
+func newOutputActivity(heartbeatFile string) *outputActivity {
+    return &outputActivity{
+        lastWrite: time.Now().UnixNano(),
+        heartbeatFile: heartbeatFile,
+    }
+}
+
+// wrap returns a writer which records activity before writing to w, a nil w discards the output
+func (a *outputActivity) wrap(w io.Writer) io.Writer {
+    if w == nil {
+        w = ioutil.Discard
+    }
+    return &activityWriter{w: w, activity: a}
+}
+
+// idleFor returns how long there is no activity until now
+func (a *outputActivity) idleFor(now time.Time) time.Duration {
+    last := time.Unix(0, atomic.LoadInt64(&a.lastWrite))
+    if a.heartbeatFile != "" {
+        if info, err := os.Stat(a.heartbeatFile); err == nil && info.ModTime().After(last) {
+            last = info.ModTime()
+        }
+    }
+    return now.Sub(last)
+}
+
+// idleCheckInterval returns the polling interval used to detect idleTimeout
+func idleCheckInterval(idleTimeout time.Duration) time.Duration {
+    interval := idleTimeout / 10
+    if interval > maxIdleCheckInterval {
+        return maxIdleCheckInterval
+    }
+    if interval < minIdleCheckInterval {
+        return minIdleCheckInterval
+    }
+    return interval
+}
+
+type activityWriter struct {
+    w io.Writer
+    activity *outputActivity
+}
+
+func (w *activityWriter) Write(p []byte) (int, error) {
+    if len(p) > 0 {
+        w.activity.touch()
+    }
+    return w.w.Write(p)
+}
+
+// touch records activity now
+func (a *outputActivity) touch() {
+    atomic.StoreInt64(&a.lastWrite, time.Now().UnixNano())
+}
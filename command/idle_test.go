@@ -0,0 +1,47 @@
+package command
+
+import (
+    "context"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestRunner_IdleTimeout(t *testing.T) {
+    r := newRunner()
+    r.SetIdleTimeout(300 * time.Millisecond)
+    result, err := r.Run(context.Background(), Spec{
+        Name: "sh",
+        Args: []string{"-c", "echo start; sleep 5"},
+        Timeout: 5 * time.Second,
+    })
+    if err != ErrCommandIdleTimeout || result.Status != IdleTimeout {
+        t.Fatalf("expect idle timeout, got status %d err %v", result.Status, err)
+    }
+    if result.Duration() >= 2*time.Second {
+        t.Errorf("idle timeout takes too long: %s", result.Duration())
+    }
+}
+
+func TestRunner_IdleTimeoutHeartbeat(t *testing.T) {
+    dir, err := ioutil.TempDir("", "heartbeat")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    heartbeat := filepath.Join(dir, "heartbeat")
+
+    r := newRunner()
+    r.SetIdleTimeout(300 * time.Millisecond)
+    r.SetHeartbeatFile(heartbeat)
+    result, err := r.Run(context.Background(), Spec{
+        Name: "sh",
+        Args: []string{"-c", "for i in 1 2 3 4 5 6; do touch " + heartbeat + "; sleep 0.1; done"},
+        Timeout: 5 * time.Second,
+    })
+    if err != nil || result.Status != Success {
+        t.Fatalf("expect success, got status %d err %v", result.Status, err)
+    }
+}
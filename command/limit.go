@@ -0,0 +1,198 @@
+package command
+
+import (
+    "fmt"
+    "io"
+    "io/ioutil"
+    "sync"
+
+    "github.com/gaodb1210/go-common/buffer/ringbuffer"
+    "github.com/gaodb1210/go-common/util/unit"
+)
+
+const (
+    // KeepHead keeps the beginning of the output
+    KeepHead int = iota
+    // KeepTail keeps the end of the output, it is written when the command finishes
+    KeepTail
+    // KeepHeadAndTail keeps the first half and the last half of the output
+    KeepHeadAndTail
+
+    truncatedMarkerFormat = "...[%d bytes truncated]..."
+)
+
+// OutputLimit limits the output a command writes to stdoutWriter and stderrWriter, zero means no limit
+type OutputLimit struct {
+    // Stdout limits the stdout size, zero means it is only limited by Total
+    Stdout unit.Bytes
+    // Stderr limits the stderr size, zero means it is only limited by Total
+    Stderr unit.Bytes
+    // Total limits the size of stdout and stderr together
+    Total unit.Bytes
+    // Policy decides which part of the output is kept, one of KeepHead, KeepTail and KeepHeadAndTail
+    Policy int
+    // KillOnExceed kills the command once any limit is exceeded
+    KillOnExceed bool
+}
+
+func (l OutputLimit) enabled() bool {
+    return l.Stdout > 0 || l.Stderr > 0 || l.Total > 0
+}
+
+// outputLimiter applies an OutputLimit to the writers of one command execution
+type outputLimiter struct {
+    mu sync.Mutex
+    limit OutputLimit
+    written int64
+    closed bool
+    exceeded chan struct{}
+    exceededOnce sync.Once
+    writers []*limitedWriter
+}
+
+func newOutputLimiter(limit OutputLimit) *outputLimiter {
+    return &outputLimiter{
+        limit: limit,
+        exceeded: make(chan struct{}),
+    }
+}
+
+// wrap returns a writer which applies the stream limit and the total limit before writing to w
+func (l *outputLimiter) wrap(w io.Writer, streamLimit unit.Bytes) io.Writer {
+    if w == nil {
+        w = ioutil.Discard
+    }
+    size := streamLimit.ToNumber()
+    if size == 0 {
+        size = l.limit.Total.ToNumber()
+    }
+    if size == 0 {
+        return w
+    }
+    lw := &limitedWriter{limiter: l, w: w}
+    switch l.limit.Policy {
+    case KeepTail:
+        lw.tailSize = size
+    case KeepHeadAndTail:
+        lw.headSize = size / 2
+        lw.tailSize = size - lw.headSize
+    default:
+        lw.headSize = size
+    }
+    if lw.tailSize > 0 {
+        lw.tail = ringbuffer.New(int(lw.tailSize))
+    }
+    l.writers = append(l.writers, lw)
+    return lw
+}
+
+// flush writes the truncated marker and the kept tail of every writer, later writes are dropped
+func (l *outputLimiter) flush() error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    l.closed = true
+    var firstErr error
+    for _, w := range l.writers {
+        if err := w.flush(); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    return firstErr
+}
+
+// room returns how many bytes may be written before the total limit is reached
+func (l *outputLimiter) room(n int64) int64 {
+    if total := l.limit.Total.ToNumber(); total > 0 && total-l.written < n {
+        n = total - l.written
+        if n < 0 {
+            n = 0
+        }
+    }
+    return n
+}
+
+func (l *outputLimiter) markExceeded() {
+    l.exceededOnce.Do(func() {
+        close(l.exceeded)
+    })
+}
+
+type limitedWriter struct {
+    limiter *outputLimiter
+    w io.Writer
+    headSize int64
+    headWritten int64
+    tailSize int64
+    tail *ringbuffer.RingBuffer
+    dropped int64
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+    l := w.limiter
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.closed {
+        return len(p), nil
+    }
+    // 1. write head
+    n := l.room(w.headSize - w.headWritten)
+    if n > int64(len(p)) {
+        n = int64(len(p))
+    }
+    if n > 0 {
+        written, err := w.w.Write(p[:n])
+        w.headWritten += int64(written)
+        l.written += int64(written)
+        if err != nil {
+            return written, err
+        }
+    }
+    rest := p[n:]
+    if len(rest) == 0 {
+        return len(p), nil
+    }
+    // 2. keep tail, drop the rest
+    if w.tail == nil {
+        w.dropped += int64(len(rest))
+    } else {
+        if int64(len(rest)) >= w.tailSize {
+            w.dropped += int64(w.tail.Length()) + int64(len(rest)) - w.tailSize
+            w.tail.Reset()
+            rest = rest[int64(len(rest))-w.tailSize:]
+        } else if excess := int64(w.tail.Length()+len(rest)) - w.tailSize; excess > 0 {
+            w.tail.Discard(int(excess))
+            w.dropped += excess
+        }
+        _, _ = w.tail.Write(rest)
+    }
+    if w.dropped > 0 {
+        l.markExceeded()
+    }
+    return len(p), nil
+}
+
+// flush writes the truncated marker and the tail, the limiter lock must be held
+func (w *limitedWriter) flush() error {
+    var tail []byte
+    if w.tail != nil {
+        head, rest := w.tail.PeekAll()
+        tail = append(append(tail, head...), rest...)
+        w.tail.Reset()
+    }
+    if n := w.limiter.room(int64(len(tail))); n < int64(len(tail)) {
+        w.dropped += int64(len(tail)) - n
+        tail = tail[int64(len(tail))-n:]
+    }
+    if w.dropped > 0 {
+        w.limiter.markExceeded()
+        if _, err := fmt.Fprintf(w.w, truncatedMarkerFormat, w.dropped); err != nil {
+            return err
+        }
+    }
+    if len(tail) > 0 {
+        written, err := w.w.Write(tail)
+        w.limiter.written += int64(written)
+        return err
+    }
+    return nil
+}
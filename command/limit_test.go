@@ -0,0 +1,54 @@
+package command
+
+import (
+    "bytes"
+    "context"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gaodb1210/go-common/util/unit"
+)
+
+func TestOutputLimiter_Policy(t *testing.T) {
+    cases := []struct {
+        policy int
+        expected string
+    }{
+        {KeepHead, "0123456789...[10 bytes truncated]..."},
+        {KeepTail, "...[10 bytes truncated]...abcdefghij"},
+        {KeepHeadAndTail, "01234...[10 bytes truncated]...fghij"},
+    }
+    for _, c := range cases {
+        output := bytes.NewBufferString("")
+        limiter := newOutputLimiter(OutputLimit{Stdout: 10, Policy: c.policy})
+        w := limiter.wrap(output, 10)
+        for _, chunk := range []string{"0123456", "789abc", "defghij"} {
+            _, _ = w.Write([]byte(chunk))
+        }
+        if err := limiter.flush(); err != nil {
+            t.Fatal(err)
+        }
+        if output.String() != c.expected {
+            t.Errorf("policy %d: expect %q, got %q", c.policy, c.expected, output.String())
+        }
+    }
+}
+
+func TestRunner_OutputLimitKill(t *testing.T) {
+    r := newRunner()
+    r.SetOutputLimit(OutputLimit{Total: unit.KB, KillOnExceed: true})
+    output := bytes.NewBufferString("")
+    result, err := r.Run(context.Background(), Spec{
+        Name: "yes",
+        Stdout: output,
+        Stderr: output,
+        Timeout: 5 * time.Second,
+    })
+    if err != ErrOutputLimitExceeded || result.Status != OutputLimitExceeded {
+        t.Fatalf("expect output limit exceeded, got status %d err %v", result.Status, err)
+    }
+    if !strings.HasPrefix(output.String(), "y\n") || output.Len() > int(unit.KB)+64 {
+        t.Errorf("unexpected output size %d", output.Len())
+    }
+}
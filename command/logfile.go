@@ -0,0 +1,207 @@
+package command
+
+import (
+    "fmt"
+    "io"
+    "io/ioutil"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gaodb1210/go-common/util/unit"
+    "gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+    defaultLogFileMaxSize = 100 * unit.MB
+    defaultLogFileMaxBackups = 7
+    defaultLogTimestampFormat = "2006-01-02 15:04:05.000"
+    // logBackupTimeFormat and compressSuffix are how lumberjack names the rotated files
+    logBackupTimeFormat = "2006-01-02T15-04-05.000"
+    compressSuffix = ".gz"
+)
+
+// LogFileConfig sends the output of a command to log files rotated by size and time
+type LogFileConfig struct {
+    // Stdout is the log file of stdout
+    Stdout string
+    // Stderr is the log file of stderr, empty or equal to Stdout means stderr goes to the Stdout file
+    Stderr string
+    // MaxSize is the size to rotate a log file, zero means 100MB
+    MaxSize unit.Bytes
+    // RotateInterval rotates the log files periodically, zero means rotate by size only
+    RotateInterval time.Duration
+    // MaxBackups is the number of rotated files to keep per log file, zero means 7
+    MaxBackups int
+    // MaxAge is the number of days to keep rotated files, zero means no limit
+    MaxAge int
+    // Compress compresses rotated files
+    Compress bool
+    // Timestamp prefixes every line with the time it is written
+    Timestamp bool
+    // TimestampFormat is the layout of the timestamp, empty means "2006-01-02 15:04:05.000"
+    TimestampFormat string
+}
+
+// logFiles holds the open log files of one run
+type logFiles struct {
+    loggers []*lumberjack.Logger
+    stop chan struct{}
+    wg sync.WaitGroup
+}
+
+// openLogFiles creates the rotated log files, and returns the writers of stdout and stderr
+func openLogFiles(config *LogFileConfig) (*logFiles, io.Writer, io.Writer) {
+    maxSize := config.MaxSize
+    if maxSize <= 0 {
+        maxSize = defaultLogFileMaxSize
+    }
+    maxBackups := config.MaxBackups
+    if maxBackups <= 0 {
+        maxBackups = defaultLogFileMaxBackups
+    }
+    l := &logFiles{stop: make(chan struct{})}
+    newLogger := func(path string) *lumberjack.Logger {
+        logger := &lumberjack.Logger{
+            Filename: path,
+            MaxSize: int((maxSize + unit.MB - 1) / unit.MB),
+            MaxAge: config.MaxAge,
+            MaxBackups: maxBackups,
+            LocalTime: true,
+            Compress: config.Compress,
+        }
+        l.loggers = append(l.loggers, logger)
+        return logger
+    }
+    stdoutLogger := newLogger(config.Stdout)
+    stderrLogger := stdoutLogger
+    if config.Stderr != "" && config.Stderr != config.Stdout {
+        stderrLogger = newLogger(config.Stderr)
+    }
+    if config.RotateInterval > 0 {
+        l.wg.Add(1)
+        go l.rotateLoop(config.RotateInterval)
+    }
+
+    var stdoutWriter, stderrWriter io.Writer = stdoutLogger, stderrLogger
+    if config.Timestamp {
+        format := config.TimestampFormat
+        if format == "" {
+            format = defaultLogTimestampFormat
+        }
+        // one timestamp writer per log file, so the lines of both streams in one file are prefixed once
+        stdoutWriter = &timestampWriter{w: stdoutLogger, format: format, lineStart: true}
+        stderrWriter = stdoutWriter
+        if stderrLogger != stdoutLogger {
+            stderrWriter = &timestampWriter{w: stderrLogger, format: format, lineStart: true}
+        }
+    }
+    return l, stdoutWriter, stderrWriter
+}
+
+func (l *logFiles) rotateLoop(interval time.Duration) {
+    defer l.wg.Done()
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            for _, logger := range l.loggers {
+                if err := logger.Rotate(); err != nil {
+                    fmt.Printf("rotate command log %s error: %v\n", logger.Filename, err)
+                }
+            }
+        case <-l.stop:
+            return
+        }
+    }
+}
+
+// paths returns the absolute paths of the current log files followed by their rotated files
+func (l *logFiles) paths() []string {
+    var current, rotated []string
+    for _, logger := range l.loggers {
+        path, err := filepath.Abs(logger.Filename)
+        if err != nil {
+            path = logger.Filename
+        }
+        current = append(current, path)
+        rotated = append(rotated, logBackups(path)...)
+    }
+    return append(current, rotated...)
+}
+
+// logBackups returns the rotated files of the log file path named by lumberjack, like name-2006-01-02T15-04-05.000.ext
+// or name-2006-01-02T15-04-05.000.ext.gz, sorted from the oldest
+func logBackups(path string) []string {
+    ext := filepath.Ext(path)
+    prefix := filepath.Base(strings.TrimSuffix(path, ext)) + "-"
+    infos, err := ioutil.ReadDir(filepath.Dir(path))
+    if err != nil {
+        return nil
+    }
+    var backups []string
+    for _, info := range infos {
+        name := info.Name()
+        if info.IsDir() || !strings.HasPrefix(name, prefix) {
+            continue
+        }
+        timestamp := strings.TrimPrefix(name, prefix)
+        if strings.HasSuffix(timestamp, ext+compressSuffix) {
+            timestamp = strings.TrimSuffix(timestamp, ext+compressSuffix)
+        } else if strings.HasSuffix(timestamp, ext) {
+            timestamp = strings.TrimSuffix(timestamp, ext)
+        } else {
+            continue
+        }
+        if _, err := time.Parse(logBackupTimeFormat, timestamp); err != nil {
+            continue
+        }
+        backups = append(backups, filepath.Join(filepath.Dir(path), name))
+    }
+    // the timestamps have a fixed width, so the names sort by time
+    sort.Strings(backups)
+    return backups
+}
+
+// close stops the time rotation and closes the log files
+func (l *logFiles) close() error {
+    close(l.stop)
+    l.wg.Wait()
+    var err error
+    for _, logger := range l.loggers {
+        if closeErr := logger.Close(); closeErr != nil && err == nil {
+            err = closeErr
+        }
+    }
+    return err
+}
+
+// timestampWriter prefixes every line with the current time
+type timestampWriter struct {
+    w io.Writer
+    format string
+    mu sync.Mutex
+    lineStart bool
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    var out []byte
+    for _, b := range p {
+        if t.lineStart {
+            out = time.Now().AppendFormat(out, t.format)
+            out = append(out, ' ')
+            t.lineStart = false
+        }
+        out = append(out, b)
+        t.lineStart = b == '\n'
+    }
+    if _, err := t.w.Write(out); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
@@ -0,0 +1,92 @@
+package command
+
+import (
+    "context"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestExecution_LogFiles(t *testing.T) {
+    dir, err := ioutil.TempDir("", "logfile")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    stdoutLog := filepath.Join(dir, "job.log")
+    stderrLog := filepath.Join(dir, "job.err.log")
+
+    r := newRunner()
+    e, err := r.Start(context.Background(), Spec{
+        Name: "sh",
+        Args: []string{"-c", "echo one; echo failed >&2; sleep 0.4; printf 'two\nthree\n'"},
+        Timeout: 3 * time.Second,
+        Log: &LogFileConfig{Stdout: stdoutLog, Stderr: stderrLog, RotateInterval: 200 * time.Millisecond, Timestamp: true},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if paths := e.LogPaths(); len(paths) != 2 || paths[0] != stdoutLog || paths[1] != stderrLog {
+        t.Errorf("unexpected log paths %v", paths)
+    }
+    if _, err := e.Wait(); err != nil {
+        t.Fatal(err)
+    }
+    paths := e.LogPaths()
+    if len(paths) < 3 {
+        t.Fatalf("expect rotated log files, got %v", paths)
+    }
+    var stdout string
+    for _, path := range paths {
+        if path == stderrLog || strings.HasPrefix(filepath.Base(path), "job.err") {
+            continue
+        }
+        content, err := ioutil.ReadFile(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        stdout += string(content)
+    }
+    line := regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}\.\d{3} (one|two|three)$`)
+    lines := strings.Split(strings.TrimSpace(stdout), "\n")
+    if len(lines) != 3 {
+        t.Fatalf("expect 3 stdout lines, got %q", stdout)
+    }
+    for _, l := range lines {
+        if !line.MatchString(l) {
+            t.Errorf("unexpected log line %q", l)
+        }
+    }
+}
+
+func TestLogBackups(t *testing.T) {
+    dir, err := ioutil.TempDir("", "logfile")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    for _, name := range []string{
+        "app.log",
+        "app-old.log",
+        "app-x-2020-01-02T03-04-05.000.log",
+        "app-2020-01-02T03-04-06.000.log.gz",
+        "app-2020-01-02T03-04-05.000.log",
+        "app-2020-01-02T03-04-05.log",
+    } {
+        if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+            t.Fatal(err)
+        }
+    }
+    backups := logBackups(filepath.Join(dir, "app.log"))
+    expected := []string{
+        filepath.Join(dir, "app-2020-01-02T03-04-05.000.log"),
+        filepath.Join(dir, "app-2020-01-02T03-04-06.000.log.gz"),
+    }
+    if strings.Join(backups, ",") != strings.Join(expected, ",") {
+        t.Errorf("expect backups %v, got %v", expected, backups)
+    }
+}
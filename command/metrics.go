@@ -0,0 +1,252 @@
+package command
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gaodb1210/go-common/util/unit"
+)
+
+const (
+    defaultMetricsMaxCommands = 50
+    otherCommandLabel = "other"
+    // exitNonZeroLabel is the status of a command which finishes with a non-zero exit code
+    exitNonZeroLabel = "exit_nonzero"
+    prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var (
+    defaultDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+    defaultRSSBuckets = []float64{
+        float64(unit.MB), float64(10 * unit.MB), float64(50 * unit.MB), float64(100 * unit.MB),
+        float64(500 * unit.MB), float64(unit.GB), float64(4 * unit.GB),
+    }
+    statusLabels = map[int]string{
+        Success: "success",
+        Fail: "fail",
+        Timeout: "timeout",
+        Canceled: "canceled",
+        IdleTimeout: "idle_timeout",
+        OutputLimitExceeded: "output_limit_exceeded",
+    }
+)
+
+// Metrics receives the measurements of every command run by a Runner
+type Metrics interface {
+    // CommandStarted is called after the command process starts
+    CommandStarted(name string)
+    // CommandFinished is called after the started command exits
+    CommandFinished(name string, status int, exitCode int, duration time.Duration, maxRSS unit.Bytes)
+    // CommandStartFailed is called when the command fails to start or is denied by the policy
+    CommandStartFailed(name string)
+}
+
+// MetricsOptions configures a MetricsRegistry
+type MetricsOptions struct {
+    // CommandLabel maps a command name to its label value, nil means the base name of the command
+    CommandLabel func(name string) string
+    // MaxCommands is the max number of distinct command labels, later commands are labeled "other", zero means 50
+    MaxCommands int
+    // DurationBuckets are the upper bounds in seconds of the duration histogram
+    DurationBuckets []float64
+    // RSSBuckets are the upper bounds in bytes of the max RSS histogram
+    RSSBuckets []float64
+}
+
+// MetricsRegistry keeps the command metrics in memory, and exposes them in the Prometheus text format
+type MetricsRegistry struct {
+    options MetricsOptions
+    mu sync.Mutex
+    commands map[string]*commandMetrics
+}
+
+type commandMetrics struct {
+    starts uint64
+    startFailures uint64
+    timeouts uint64
+    completions map[string]uint64
+    duration *histogram
+    maxRSS *histogram
+}
+
+type histogram struct {
+    buckets []float64
+    counts []uint64
+    sum float64
+    count uint64
+}
+
+// NewMetricsRegistry creates a MetricsRegistry
+func NewMetricsRegistry(options MetricsOptions) *MetricsRegistry {
+    if options.CommandLabel == nil {
+        options.CommandLabel = filepath.Base
+    }
+    if options.MaxCommands <= 0 {
+        options.MaxCommands = defaultMetricsMaxCommands
+    }
+    if len(options.DurationBuckets) == 0 {
+        options.DurationBuckets = defaultDurationBuckets
+    }
+    if len(options.RSSBuckets) == 0 {
+        options.RSSBuckets = defaultRSSBuckets
+    }
+    return &MetricsRegistry{options: options, commands: make(map[string]*commandMetrics)}
+}
+
+// CommandStarted counts a started command
+func (m *MetricsRegistry) CommandStarted(name string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.command(name).starts++
+}
+
+// CommandFinished counts a finished command by status, a command which exits with a non-zero code
+// is counted as exit_nonzero, and observes its duration and max RSS
+func (m *MetricsRegistry) CommandFinished(name string, status int, exitCode int, duration time.Duration, maxRSS unit.Bytes) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    c := m.command(name)
+    label := statusLabel(status)
+    if status == Success && exitCode != 0 {
+        label = exitNonZeroLabel
+    }
+    c.completions[label]++
+    if status == Timeout || status == IdleTimeout {
+        c.timeouts++
+    }
+    c.duration.observe(duration.Seconds())
+    if maxRSS > 0 {
+        c.maxRSS.observe(float64(maxRSS))
+    }
+}
+
+// CommandStartFailed counts a command which fails to start
+func (m *MetricsRegistry) CommandStartFailed(name string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.command(name).startFailures++
+}
+
+// command returns the metrics of the label of name, m.mu must be held
+func (m *MetricsRegistry) command(name string) *commandMetrics {
+    label := m.options.CommandLabel(name)
+    if _, ok := m.commands[label]; !ok && len(m.commands) >= m.options.MaxCommands {
+        label = otherCommandLabel
+    }
+    c, ok := m.commands[label]
+    if !ok {
+        c = &commandMetrics{
+            completions: make(map[string]uint64),
+            duration: newHistogram(m.options.DurationBuckets),
+            maxRSS: newHistogram(m.options.RSSBuckets),
+        }
+        m.commands[label] = c
+    }
+    return c
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format
+func (m *MetricsRegistry) WritePrometheus(w io.Writer) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    labels := make([]string, 0, len(m.commands))
+    for label := range m.commands {
+        labels = append(labels, label)
+    }
+    sort.Strings(labels)
+    var b strings.Builder
+
+    writeHeader(&b, "command_starts_total", "counter", "Number of started commands.")
+    for _, label := range labels {
+        fmt.Fprintf(&b, "command_starts_total{command=\"%s\"} %d\n", escapeLabel(label), m.commands[label].starts)
+    }
+    writeHeader(&b, "command_start_failures_total", "counter", "Number of commands which failed to start.")
+    for _, label := range labels {
+        fmt.Fprintf(&b, "command_start_failures_total{command=\"%s\"} %d\n", escapeLabel(label), m.commands[label].startFailures)
+    }
+    writeHeader(&b, "command_completions_total", "counter", "Number of finished commands by status, exit_nonzero for a non-zero exit code.")
+    for _, label := range labels {
+        completions := m.commands[label].completions
+        statuses := make([]string, 0, len(completions))
+        for status := range completions {
+            statuses = append(statuses, status)
+        }
+        sort.Strings(statuses)
+        for _, status := range statuses {
+            fmt.Fprintf(&b, "command_completions_total{command=\"%s\",status=\"%s\"} %d\n", escapeLabel(label), status, completions[status])
+        }
+    }
+    writeHeader(&b, "command_timeouts_total", "counter", "Number of commands killed by a timeout or an idle timeout.")
+    for _, label := range labels {
+        fmt.Fprintf(&b, "command_timeouts_total{command=\"%s\"} %d\n", escapeLabel(label), m.commands[label].timeouts)
+    }
+    writeHeader(&b, "command_duration_seconds", "histogram", "Duration of finished commands.")
+    for _, label := range labels {
+        m.commands[label].duration.write(&b, "command_duration_seconds", label)
+    }
+    writeHeader(&b, "command_max_rss_bytes", "histogram", "Max resident set size of finished commands.")
+    for _, label := range labels {
+        m.commands[label].maxRSS.write(&b, "command_max_rss_bytes", label)
+    }
+    _, err := io.WriteString(w, b.String())
+    return err
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (m *MetricsRegistry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+    w.Header().Set("Content-Type", prometheusContentType)
+    if err := m.WritePrometheus(w); err != nil {
+        fmt.Printf("write command metrics error: %v\n", err)
+    }
+}
+
+func newHistogram(buckets []float64) *histogram {
+    return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+    for i, bound := range h.buckets {
+        if value <= bound {
+            h.counts[i]++
+        }
+    }
+    h.sum += value
+    h.count++
+}
+
+// write writes the cumulative buckets, the sum and the count of the histogram
+func (h *histogram) write(b *strings.Builder, name string, label string) {
+    label = escapeLabel(label)
+    for i, bound := range h.buckets {
+        fmt.Fprintf(b, "%s_bucket{command=\"%s\",le=\"%s\"} %d\n", name, label, formatFloat(bound), h.counts[i])
+    }
+    fmt.Fprintf(b, "%s_bucket{command=\"%s\",le=\"+Inf\"} %d\n", name, label, h.count)
+    fmt.Fprintf(b, "%s_sum{command=\"%s\"} %s\n", name, label, formatFloat(h.sum))
+    fmt.Fprintf(b, "%s_count{command=\"%s\"} %d\n", name, label, h.count)
+}
+
+func writeHeader(b *strings.Builder, name string, kind string, help string) {
+    fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func statusLabel(status int) string {
+    if label, ok := statusLabels[status]; ok {
+        return label
+    }
+    return strconv.Itoa(status)
+}
+
+func escapeLabel(value string) string {
+    return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+    return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,45 @@
+package command
+
+import (
+    "context"
+    "io/ioutil"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestMetricsRegistry_Prometheus(t *testing.T) {
+    metrics := NewMetricsRegistry(MetricsOptions{MaxCommands: 2, DurationBuckets: []float64{0.5, 5}})
+    r := newRunner()
+    r.SetMetrics(metrics)
+    _, _ = r.Run(context.Background(), Spec{Name: "sh", Args: []string{"-c", "exit 0"}, Timeout: 2 * time.Second})
+    _, _ = r.Run(context.Background(), Spec{Name: "/bin/sh", Args: []string{"-c", "exit 1"}, Timeout: 2 * time.Second})
+    _, _ = r.Run(context.Background(), Spec{Name: "sleep", Args: []string{"1"}, Timeout: 100 * time.Millisecond})
+    _, _ = r.Run(context.Background(), Spec{Name: "true", Timeout: 2 * time.Second})
+    _ = r.SyncRunSimple("sh", []string{"-c", "exit 0"}, 2)
+    // a start failure is not observed by the duration histogram
+    _, _ = r.Run(context.Background(), Spec{Name: "/nonexistent/sh"})
+
+    recorder := httptest.NewRecorder()
+    metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+    body, _ := ioutil.ReadAll(recorder.Body)
+    for _, line := range []string{
+        "# TYPE command_starts_total counter",
+        `command_starts_total{command="sh"} 3`,
+        `command_start_failures_total{command="sh"} 1`,
+        `command_starts_total{command="other"} 1`,
+        `command_completions_total{command="sh",status="exit_nonzero"} 1`,
+        `command_completions_total{command="sh",status="success"} 2`,
+        `command_completions_total{command="sleep",status="timeout"} 1`,
+        `command_timeouts_total{command="sleep"} 1`,
+        `command_duration_seconds_bucket{command="sh",le="0.5"} 3`,
+        `command_duration_seconds_bucket{command="sh",le="+Inf"} 3`,
+        `command_duration_seconds_count{command="other"} 1`,
+        `command_max_rss_bytes_count{command="sh"} 3`,
+    } {
+        if !strings.Contains(string(body), line+"\n") {
+            t.Errorf("expect line %q in:\n%s", line, body)
+        }
+    }
+}
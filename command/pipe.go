@@ -0,0 +1,148 @@
+package command
+
+import (
+    "io"
+    "os"
+    "os/exec"
+    "sync"
+    "time"
+)
+
+// outputPipes copies the output of a command from pipes owned by the runner, so that the output
+// is completely copied, or the copy is stopped, before the command result is returned
+type outputPipes struct {
+    readers []*os.File
+    writers []*os.File
+    wg sync.WaitGroup
+    done chan struct{}
+}
+
+// newOutputPipes creates the pipes of cmd for the stdout and stderr writers, a nil writer gets no pipe
+func newOutputPipes(cmd *exec.Cmd, stdoutWriter io.Writer, stderrWriter io.Writer) (*outputPipes, error) {
+    p := &outputPipes{done: make(chan struct{})}
+    var err error
+    if stdoutWriter != nil {
+        if cmd.Stdout, err = p.add(stdoutWriter); err != nil {
+            p.close()
+            return nil, err
+        }
+    }
+    if stderrWriter != nil {
+        // like exec.Cmd, the same writer shares one pipe so that it is not written concurrently
+        if stdoutWriter != nil && interfaceEqual(stdoutWriter, stderrWriter) {
+            cmd.Stderr = cmd.Stdout
+        } else if cmd.Stderr, err = p.add(stderrWriter); err != nil {
+            p.close()
+            return nil, err
+        }
+    }
+    return p, nil
+}
+
+func (p *outputPipes) add(w io.Writer) (*os.File, error) {
+    pr, pw, err := os.Pipe()
+    if err != nil {
+        return nil, err
+    }
+    p.readers = append(p.readers, pr)
+    p.writers = append(p.writers, pw)
+    p.wg.Add(1)
+    go func() {
+        defer p.wg.Done()
+        _, _ = io.Copy(w, pr)
+    }()
+    return pw, nil
+}
+
+// started closes the write ends held by this process once the command started
+func (p *outputPipes) started() {
+    for _, pw := range p.writers {
+        _ = pw.Close()
+    }
+    p.writers = nil
+    go func() {
+        p.wg.Wait()
+        close(p.done)
+    }()
+}
+
+// wait waits until the output is copied, a process which inherited the pipes may keep them open,
+// so the copy is stopped after delay
+func (p *outputPipes) wait(delay time.Duration) {
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+    select {
+    case <-p.done:
+    case <-timer.C:
+        for _, pr := range p.readers {
+            _ = pr.Close()
+        }
+        <-p.done
+    }
+    p.close()
+}
+
+// close closes all pipes, it is used when the command fails to start
+func (p *outputPipes) close() {
+    for _, pw := range p.writers {
+        _ = pw.Close()
+    }
+    for _, pr := range p.readers {
+        _ = pr.Close()
+    }
+}
+
+// teeWriter returns a writer which writes to both writers, a nil w is skipped
+func teeWriter(log io.Writer, w io.Writer) io.Writer {
+    if w == nil {
+        return log
+    }
+    return io.MultiWriter(log, w)
+}
+
+// teeOutput tees the stdout and stderr writers to the log writers. The streams are copied concurrently,
+// so a writer shared by both streams is written by one tee, or locked when the streams go to different logs.
+func teeOutput(stdoutLog io.Writer, stderrLog io.Writer, stdoutWriter io.Writer, stderrWriter io.Writer) (io.Writer, io.Writer) {
+    if interfaceEqual(stdoutLog, stderrLog) {
+        return wrapOutput(stdoutWriter, stderrWriter, func(w io.Writer) io.Writer {
+            return teeWriter(stdoutLog, w)
+        })
+    }
+    if stdoutWriter != nil && interfaceEqual(stdoutWriter, stderrWriter) {
+        shared := &lockedWriter{w: stdoutWriter}
+        stdoutWriter, stderrWriter = shared, shared
+    }
+    return teeWriter(stdoutLog, stdoutWriter), teeWriter(stderrLog, stderrWriter)
+}
+
+// lockedWriter serializes the writes to w
+type lockedWriter struct {
+    mu sync.Mutex
+    w io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.w.Write(p)
+}
+
+// wrapOutput wraps the stdout and stderr writers, like exec.Cmd the same writer of both streams is wrapped once,
+// so that the streams still share one pipe and the writer is not written concurrently
+func wrapOutput(stdoutWriter io.Writer, stderrWriter io.Writer, wrap func(w io.Writer) io.Writer) (io.Writer, io.Writer) {
+    if interfaceEqual(stdoutWriter, stderrWriter) {
+        w := wrap(stdoutWriter)
+        return w, w
+    }
+    return wrap(stdoutWriter), wrap(stderrWriter)
+}
+
+// interfaceEqual protects against panics from comparing incomparable writers
+func interfaceEqual(a, b interface{}) (equal bool) {
+    defer func() {
+        if recover() != nil {
+            equal = false
+        }
+    }()
+    return a == b
+}
@@ -0,0 +1,150 @@
+package command
+
+import (
+    "bytes"
+    "context"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+)
+
+// TestWrapOutput_SharedWriter runs every wrapper of the output writers with both streams writing to one buffer,
+// run it with -race
+func TestWrapOutput_SharedWriter(t *testing.T) {
+    dir, err := ioutil.TempDir("", "shared")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    for _, c := range []struct {
+        name string
+        setup func(r *Runner, spec *Spec)
+        // run runs spec, nil means Run
+        run func(r *Runner, spec Spec) (*Result, error)
+        // output is the expected output, empty means the output of the script
+        output string
+        check func(t *testing.T, result *Result)
+    }{
+        {
+            name: "idle",
+            setup: func(r *Runner, spec *Spec) {
+                r.SetIdleTimeout(time.Second)
+            },
+        },
+        {
+            name: "redact",
+            setup: func(r *Runner, spec *Spec) {
+                r.AddSecret("err")
+            },
+            output: strings.Repeat("out\n"+redactedMask+"\n", 10),
+        },
+        {
+            name: "tail",
+            setup: func(r *Runner, spec *Spec) {
+                r.SetOutputTailSize(4)
+            },
+            check: func(t *testing.T, result *Result) {
+                if result.OutputTail != "err\n" {
+                    t.Errorf("unexpected tail %q", result.OutputTail)
+                }
+            },
+        },
+        {
+            name: "log probe",
+            run: func(r *Runner, spec Spec) (*Result, error) {
+                e, err := r.StartAndWaitReady(context.Background(), spec, Probe{Type: ProbeLog, Target: "^err$"})
+                if err != nil {
+                    return nil, err
+                }
+                return e.Wait()
+            },
+        },
+        {
+            name: "log file",
+            setup: func(r *Runner, spec *Spec) {
+                spec.Log = &LogFileConfig{Stdout: filepath.Join(dir, "shared.log"), Timestamp: true}
+            },
+            check: func(t *testing.T, result *Result) {
+                checkLogLines(t, filepath.Join(dir, "shared.log"))
+            },
+        },
+        {
+            name: "log files",
+            setup: func(r *Runner, spec *Spec) {
+                spec.Log = &LogFileConfig{Stdout: filepath.Join(dir, "job.log"), Stderr: filepath.Join(dir, "job.err.log"), Timestamp: true}
+            },
+            check: func(t *testing.T, result *Result) {
+                checkLogLines(t, filepath.Join(dir, "job.log"), filepath.Join(dir, "job.err.log"))
+            },
+        },
+    } {
+        t.Run(c.name, func(t *testing.T) {
+            r := newRunner()
+            output := bytes.NewBufferString("")
+            spec := Spec{
+                Name: "sh",
+                Args: []string{"-c", "for i in 1 2 3 4 5 6 7 8 9 10; do echo out; echo err >&2; done"},
+                Stdout: output,
+                Stderr: output,
+                Timeout: 3 * time.Second,
+            }
+            if c.setup != nil {
+                c.setup(r, &spec)
+            }
+            run := c.run
+            if run == nil {
+                run = func(r *Runner, spec Spec) (*Result, error) {
+                    return r.Run(context.Background(), spec)
+                }
+            }
+            result, err := run(r, spec)
+            if err != nil || result.Status != Success {
+                t.Fatalf("unexpected result %+v, err %v", result, err)
+            }
+            expected := c.output
+            if expected == "" {
+                expected = strings.Repeat("out\nerr\n", 10)
+            }
+            // the streams have separate pipes when they go to different log files, compare the lines in any order
+            if sortedLines(output.String()) != sortedLines(expected) {
+                t.Errorf("unexpected output %q", output.String())
+            }
+            if c.check != nil {
+                c.check(t, result)
+            }
+        })
+    }
+}
+
+// checkLogLines checks that the log files hold 20 lines of out and err, each with one timestamp
+func checkLogLines(t *testing.T, paths ...string) {
+    line := regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}\.\d{3} (out|err)$`)
+    var lines []string
+    for _, path := range paths {
+        content, err := ioutil.ReadFile(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        lines = append(lines, strings.Split(strings.TrimSpace(string(content)), "\n")...)
+    }
+    if len(lines) != 20 {
+        t.Errorf("expect 20 log lines, got %q", lines)
+    }
+    for _, l := range lines {
+        if !line.MatchString(l) {
+            t.Errorf("unexpected log line %q", l)
+        }
+    }
+}
+
+func sortedLines(s string) string {
+    lines := strings.SplitAfter(s, "\n")
+    sort.Strings(lines)
+    return strings.Join(lines, "")
+}
@@ -0,0 +1,250 @@
+package command
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "time"
+
+    "gopkg.in/yaml.v3"
+)
+
+const (
+    // maxSymlinks is the limit of links followed in a path, like the kernel does
+    maxSymlinks = 40
+)
+
+var (
+    ErrPolicyDenied = errors.New("command denied by policy")
+)
+
+// PolicyError is returned when the policy denies a command, it matches ErrPolicyDenied with errors.Is
+type PolicyError struct {
+    Command string
+    Reason string
+}
+
+func (e *PolicyError) Error() string {
+    return fmt.Sprintf("%s: %s: %s", ErrPolicyDenied, e.Command, e.Reason)
+}
+
+// Is reports whether target is ErrPolicyDenied
+func (e *PolicyError) Is(target error) bool {
+    return target == ErrPolicyDenied
+}
+
+// PolicyExecutable allows one executable
+type PolicyExecutable struct {
+    // Path is the absolute path of the executable, the path inside the root when the Runner has a chroot
+    Path string `yaml:"path"`
+    // SHA256 is the hex sha256 of the executable file, empty means any content
+    SHA256 string `yaml:"sha256"`
+    // Args are regexp patterns matching a whole argument, every argument must match one of them, empty means any arguments
+    Args []string `yaml:"args"`
+
+    args []*regexp.Regexp
+}
+
+// Policy restricts what a Runner executes, it is checked before a command starts
+type Policy struct {
+    // Executables are the allowed executables
+    Executables []PolicyExecutable `yaml:"executables"`
+    // Users are the allowed target users of SetUser
+    Users []string `yaml:"users"`
+    // MaxTimeout is the max command timeout, a command without timeout is denied, zero means no limit
+    MaxTimeout time.Duration `yaml:"max_timeout"`
+}
+
+// LoadPolicy reads a policy from a YAML file
+func LoadPolicy(path string) (*Policy, error) {
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    return ParsePolicy(content)
+}
+
+// ParsePolicy parses a policy from YAML, like
+//
+//  executables:
+//    - path: /usr/bin/systemctl
+//      sha256: 3f1c...
+//      args: ["restart|status", "nginx\\.service"]
+//  users: [deploy]
+//  max_timeout: 10m
+func ParsePolicy(content []byte) (*Policy, error) {
+    policy := &Policy{}
+    if err := yaml.Unmarshal(content, policy); err != nil {
+        return nil, err
+    }
+    for i := range policy.Executables {
+        executable := &policy.Executables[i]
+        if !filepath.IsAbs(executable.Path) {
+            return nil, fmt.Errorf("policy executable %q is not an absolute path", executable.Path)
+        }
+        executable.Path = filepath.Clean(executable.Path)
+        executable.SHA256 = strings.ToLower(executable.SHA256)
+        for _, pattern := range executable.Args {
+            re, err := regexp.Compile("^(?:" + pattern + ")$")
+            if err != nil {
+                return nil, fmt.Errorf("policy executable %q: %v", executable.Path, err)
+            }
+            executable.args = append(executable.args, re)
+        }
+    }
+    return policy, nil
+}
+
+// check returns a *PolicyError when the policy denies running spec as user.
+// With a chroot the executable is an absolute path inside the root, and the file hashed is the one the command runs.
+func (p *Policy) check(spec Spec, user string, chroot string) error {
+    path, hostPath := "", ""
+    if chroot == "" {
+        var err error
+        if path, err = resolveExecutable(spec.Name, spec.Dir); err != nil {
+            return &PolicyError{Command: spec.Name, Reason: err.Error()}
+        }
+        hostPath = path
+    } else {
+        if !filepath.IsAbs(spec.Name) {
+            return &PolicyError{Command: spec.Name, Reason: "executable is not an absolute path inside the chroot"}
+        }
+        path = filepath.Clean(spec.Name)
+    }
+    var executable *PolicyExecutable
+    for i := range p.Executables {
+        if p.Executables[i].Path == path {
+            executable = &p.Executables[i]
+            break
+        }
+    }
+    if executable == nil {
+        return &PolicyError{Command: path, Reason: "executable is not allowed"}
+    }
+    if executable.SHA256 != "" {
+        if chroot != "" {
+            var err error
+            if hostPath, err = resolveInRoot(chroot, path); err != nil {
+                return &PolicyError{Command: path, Reason: err.Error()}
+            }
+        }
+        sum, err := fileSHA256(hostPath)
+        if err != nil {
+            return &PolicyError{Command: path, Reason: err.Error()}
+        }
+        if sum != executable.SHA256 {
+            return &PolicyError{Command: path, Reason: "sha256 " + sum + " does not match"}
+        }
+    }
+    if len(executable.args) > 0 {
+        for i, arg := range spec.Args {
+            if !matchAny(executable.args, arg) {
+                return &PolicyError{Command: path, Reason: fmt.Sprintf("argument %d is not allowed", i+1)}
+            }
+        }
+    }
+    if user != "" && !containsString(p.Users, user) {
+        return &PolicyError{Command: path, Reason: fmt.Sprintf("user %q is not allowed", user)}
+    }
+    if p.MaxTimeout > 0 && (spec.Timeout <= 0 || spec.Timeout > p.MaxTimeout) {
+        return &PolicyError{Command: path, Reason: fmt.Sprintf("timeout %s exceeds %s", spec.Timeout, p.MaxTimeout)}
+    }
+    return nil
+}
+
+// resolveExecutable returns the absolute path of the executable run for name in dir
+func resolveExecutable(name string, dir string) (string, error) {
+    if !strings.Contains(name, "/") {
+        var err error
+        if name, err = exec.LookPath(name); err != nil {
+            return "", err
+        }
+    }
+    if !filepath.IsAbs(name) {
+        if dir == "" {
+            var err error
+            if dir, err = os.Getwd(); err != nil {
+                return "", err
+            }
+        }
+        name = filepath.Join(dir, name)
+    }
+    return filepath.Clean(name), nil
+}
+
+// resolveInRoot returns the host path of path inside root, the symlinks are followed as if root were /
+func resolveInRoot(root string, path string) (string, error) {
+    resolved := "/"
+    rest := strings.Split(strings.TrimPrefix(filepath.Clean(path), "/"), "/")
+    for links := 0; len(rest) > 0; {
+        name := rest[0]
+        rest = rest[1:]
+        if name == "" || name == "." {
+            continue
+        }
+        if name == ".." {
+            resolved = filepath.Dir(resolved)
+            continue
+        }
+        next := filepath.Join(resolved, name)
+        info, err := os.Lstat(filepath.Join(root, next))
+        if err != nil {
+            return "", err
+        }
+        if info.Mode()&os.ModeSymlink == 0 {
+            resolved = next
+            continue
+        }
+        if links++; links > maxSymlinks {
+            return "", fmt.Errorf("too many links in %s", path)
+        }
+        target, err := os.Readlink(filepath.Join(root, next))
+        if err != nil {
+            return "", err
+        }
+        if filepath.IsAbs(target) {
+            resolved = "/"
+        }
+        rest = append(strings.Split(strings.TrimPrefix(target, "/"), "/"), rest...)
+    }
+    return filepath.Join(root, resolved), nil
+}
+
+func fileSHA256(path string) (string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    h := sha256.New()
+    if _, err := io.Copy(h, f); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func matchAny(patterns []*regexp.Regexp, value string) bool {
+    for _, re := range patterns {
+        if re.MatchString(value) {
+            return true
+        }
+    }
+    return false
+}
+
+func containsString(values []string, value string) bool {
+    for _, v := range values {
+        if v == value {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,118 @@
+package command
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestPolicy_Check(t *testing.T) {
+    sh, err := resolveExecutable("sh", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    sum, err := fileSHA256(sh)
+    if err != nil {
+        t.Fatal(err)
+    }
+    dir, err := ioutil.TempDir("", "policy")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "policy.yaml")
+    content := fmt.Sprintf(`
+executables:
+  - path: %s
+    sha256: %s
+    args: ["-c", "echo [a-z]+"]
+  - path: /bin/true
+    sha256: "0000"
+users: [deploy]
+max_timeout: 10s
+`, sh, sum)
+    if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+        t.Fatal(err)
+    }
+    policy, err := LoadPolicy(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    r := newRunner()
+    r.SetPolicy(policy)
+
+    result, err := r.Run(context.Background(), Spec{Name: "sh", Args: []string{"-c", "echo hello"}, Timeout: 5 * time.Second})
+    if err != nil || result.ExitCode != 0 {
+        t.Fatalf("expect allowed, got %v", err)
+    }
+    for _, spec := range []Spec{
+        {Name: "sh", Args: []string{"-c", "echo hello; id"}, Timeout: time.Second},
+        {Name: "sh", Args: []string{"-c", "echo hello"}},
+        {Name: "sh", Args: []string{"-c", "echo hello"}, Timeout: time.Minute},
+        {Name: "/bin/true", Timeout: time.Second},
+        {Name: "/bin/false", Timeout: time.Second},
+    } {
+        result, err := r.Run(context.Background(), spec)
+        var policyErr *PolicyError
+        if !errors.Is(err, ErrPolicyDenied) || !errors.As(err, &policyErr) || result.Status != Fail {
+            t.Errorf("expect denied for %+v, got %v", spec, err)
+        }
+    }
+    r.SetUser("root")
+    if _, err := r.Run(context.Background(), Spec{Name: "sh", Args: []string{"-c", "echo hello"}, Timeout: time.Second}); !errors.Is(err, ErrPolicyDenied) {
+        t.Errorf("expect user denied, got %v", err)
+    }
+}
+
+func TestPolicy_CheckChroot(t *testing.T) {
+    root, err := ioutil.TempDir("", "chroot")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(root)
+    if err := os.MkdirAll(filepath.Join(root, "usr", "bin"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    tool := filepath.Join(root, "usr", "bin", "tool")
+    if err := ioutil.WriteFile(tool, []byte("tool"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    sum, err := fileSHA256(tool)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // an absolute link is followed inside the root, not on the host
+    if err := os.Symlink("usr/bin", filepath.Join(root, "bin")); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Symlink("/bin/tool", filepath.Join(root, "usr", "bin", "link")); err != nil {
+        t.Fatal(err)
+    }
+    policy, err := ParsePolicy([]byte(fmt.Sprintf(`
+executables:
+  - path: /usr/bin/link
+    sha256: %s
+  - path: /bin/tool
+    sha256: "0000"
+`, sum)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := policy.check(Spec{Name: "/usr/bin/link"}, "", root); err != nil {
+        t.Errorf("expect allowed, got %v", err)
+    }
+    for _, spec := range []Spec{
+        {Name: "/bin/tool"},
+        {Name: "/usr/bin/tool"},
+        {Name: "link", Dir: "/usr/bin"},
+    } {
+        if err := policy.check(spec, "", root); !errors.Is(err, ErrPolicyDenied) {
+            t.Errorf("expect %s denied, got %v", spec.Name, err)
+        }
+    }
+}
@@ -0,0 +1,219 @@
+package command
+
+import (
+    "container/heap"
+    "context"
+    "errors"
+    "sync"
+)
+
+var (
+    // ErrPoolClosed -- the pool does not accept jobs after Drain or Shutdown
+    ErrPoolClosed = errors.New("command pool is closed")
+)
+
+// Pool runs commands with a bounded parallelism, each job runs on its own copy of the runner
+type Pool struct {
+    runner *Runner
+    mu sync.Mutex
+    cond *sync.Cond
+    queue jobQueue
+    running map[*Job]struct{}
+    seq uint64
+    closed bool
+    wg sync.WaitGroup
+}
+
+// NewPool creates a Pool which runs at most parallelism jobs at the same time, with the config of runner
+func NewPool(runner *Runner, parallelism int) *Pool {
+    if runner == nil {
+        runner = newRunner()
+    }
+    if parallelism <= 0 {
+        parallelism = 1
+    }
+    p := &Pool{
+        runner: runner.Clone(),
+        running: make(map[*Job]struct{}),
+    }
+    p.cond = sync.NewCond(&p.mu)
+    p.wg.Add(parallelism)
+    for i := 0; i < parallelism; i++ {
+        go p.worker()
+    }
+    return p
+}
+
+// Submit queues spec, jobs with higher priority run first, jobs with the same priority run in submit order.
+// The job is canceled when ctx is done.
+func (p *Pool) Submit(ctx context.Context, spec Spec, priority int) (*Job, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.closed {
+        return nil, ErrPoolClosed
+    }
+    p.seq++
+    job := &Job{
+        pool: p,
+        spec: spec,
+        priority: priority,
+        seq: p.seq,
+        done: make(chan struct{}),
+    }
+    job.ctx, job.cancel = context.WithCancel(ctx)
+    heap.Push(&p.queue, job)
+    p.cond.Signal()
+    return job, nil
+}
+
+// QueueDepth returns the number of jobs waiting to run
+func (p *Pool) QueueDepth() int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return p.queue.Len()
+}
+
+// InFlight returns the number of running jobs
+func (p *Pool) InFlight() int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return len(p.running)
+}
+
+// Drain stops accepting jobs, and waits for the queued and running jobs to finish
+func (p *Pool) Drain() {
+    p.mu.Lock()
+    p.closed = true
+    p.cond.Broadcast()
+    p.mu.Unlock()
+    p.wg.Wait()
+}
+
+// Shutdown stops accepting jobs, cancels the queued and running jobs, and waits for the workers to exit
+func (p *Pool) Shutdown() {
+    p.mu.Lock()
+    p.closed = true
+    for p.queue.Len() > 0 {
+        job := heap.Pop(&p.queue).(*Job)
+        job.cancel()
+        job.finish(&Result{Name: p.runner.secrets.String(job.spec.Name), Status: Canceled}, ErrPoolClosed)
+    }
+    for job := range p.running {
+        job.cancel()
+    }
+    p.cond.Broadcast()
+    p.mu.Unlock()
+    p.wg.Wait()
+}
+
+func (p *Pool) worker() {
+    defer p.wg.Done()
+    for {
+        p.mu.Lock()
+        for p.queue.Len() == 0 && !p.closed {
+            p.cond.Wait()
+        }
+        if p.queue.Len() == 0 {
+            p.mu.Unlock()
+            return
+        }
+        job := heap.Pop(&p.queue).(*Job)
+        p.running[job] = struct{}{}
+        p.mu.Unlock()
+
+        job.run(p.runner.Clone())
+
+        p.mu.Lock()
+        delete(p.running, job)
+        p.mu.Unlock()
+    }
+}
+
+// Job is the handle of a command submitted to a Pool
+type Job struct {
+    pool *Pool
+    spec Spec
+    priority int
+    seq uint64
+    index int
+    ctx context.Context
+    cancel context.CancelFunc
+    done chan struct{}
+    result *Result
+    err error
+}
+
+// Done returns a channel which is closed when the job finishes
+func (j *Job) Done() <-chan struct{} {
+    return j.done
+}
+
+// Wait waits for the job to finish and returns its result
+func (j *Job) Wait() (*Result, error) {
+    <-j.done
+    return j.result, j.err
+}
+
+// Cancel removes the job from the queue, or kills it when it is running
+func (j *Job) Cancel() {
+    j.cancel()
+    p := j.pool
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if j.index >= 0 && j.index < p.queue.Len() && p.queue[j.index] == j {
+        heap.Remove(&p.queue, j.index)
+        j.finish(&Result{Name: p.runner.secrets.String(j.spec.Name), Status: Canceled}, context.Canceled)
+    }
+}
+
+func (j *Job) run(runner *Runner) {
+    defer j.cancel()
+    if err := j.ctx.Err(); err != nil {
+        j.finish(&Result{Name: runner.secrets.String(j.spec.Name), Status: Canceled}, err)
+        return
+    }
+    result, err := runner.Run(j.ctx, j.spec)
+    j.finish(result, err)
+}
+
+func (j *Job) finish(result *Result, err error) {
+    j.result = result
+    j.err = err
+    close(j.done)
+}
+
+// jobQueue is a priority queue of jobs, implementing heap.Interface
+type jobQueue []*Job
+
+func (q jobQueue) Len() int {
+    return len(q)
+}
+
+func (q jobQueue) Less(i, j int) bool {
+    if q[i].priority != q[j].priority {
+        return q[i].priority > q[j].priority
+    }
+    return q[i].seq < q[j].seq
+}
+
+func (q jobQueue) Swap(i, j int) {
+    q[i], q[j] = q[j], q[i]
+    q[i].index = i
+    q[j].index = j
+}
+
+func (q *jobQueue) Push(x interface{}) {
+    job := x.(*Job)
+    job.index = len(*q)
+    *q = append(*q, job)
+}
+
+func (q *jobQueue) Pop() interface{} {
+    old := *q
+    n := len(old)
+    job := old[n-1]
+    old[n-1] = nil
+    job.index = -1
+    *q = old[:n-1]
+    return job
+}
@@ -0,0 +1,64 @@
+package command
+
+import (
+    "bytes"
+    "context"
+    "sync"
+    "testing"
+    "time"
+)
+
+// lockedBuffer is a bytes.Buffer safe for concurrent writers
+type lockedBuffer struct {
+    mu sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.String()
+}
+
+func TestPool_Priority(t *testing.T) {
+    p := NewPool(newRunner(), 1)
+    output := &lockedBuffer{}
+    blocker, err := p.Submit(context.Background(), Spec{Name: "sleep", Args: []string{"0.3"}}, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    time.Sleep(100 * time.Millisecond)
+    var jobs []*Job
+    for i, name := range []string{"low", "high", "mid"} {
+        job, err := p.Submit(context.Background(), Spec{Name: "echo", Args: []string{name}, Stdout: output}, []int{1, 3, 2}[i])
+        if err != nil {
+            t.Fatal(err)
+        }
+        jobs = append(jobs, job)
+    }
+    if p.QueueDepth() != 3 || p.InFlight() != 1 {
+        t.Errorf("expect 3 queued and 1 in flight, got %d and %d", p.QueueDepth(), p.InFlight())
+    }
+    canceled, _ := p.Submit(context.Background(), Spec{Name: "echo", Args: []string{"canceled"}, Stdout: output}, 0)
+    canceled.Cancel()
+    p.Drain()
+
+    if result, err := blocker.Wait(); err != nil || result.Status != Success {
+        t.Errorf("blocker job failed: %v", err)
+    }
+    if result, _ := canceled.Wait(); result.Status != Canceled {
+        t.Errorf("expect canceled job, got status %d", result.Status)
+    }
+    if output.String() != "high\nmid\nlow\n" {
+        t.Errorf("unexpected job order: %q", output.String())
+    }
+    if _, err := p.Submit(context.Background(), Spec{Name: "true"}, 0); err != ErrPoolClosed {
+        t.Errorf("expect ErrPoolClosed, got %v", err)
+    }
+}
@@ -8,39 +8,45 @@ import (
     "strconv"
     "strings"
     "syscall"
+    "time"
+
+    "github.com/gaodb1210/go-common/util/unit"
 )
 
-func (r *Runner) preProcess() error {
+func (r *Runner) preProcess(cmd *exec.Cmd) error {
     // 1.init command pgid
-    if r.command.SysProcAttr == nil {
-        r.command.SysProcAttr = &syscall.SysProcAttr{
+    if cmd.SysProcAttr == nil {
+        cmd.SysProcAttr = &syscall.SysProcAttr{
             Setpgid: true,
             Pgid: 0,
         }
     }
+    if r.chroot != "" {
+        cmd.SysProcAttr.Chroot = r.chroot
+    }
     // 2.init command execute Env
     var env []string
-    if r.command.Env == nil || len(r.command.Env) == 0 {
+    if cmd.Env == nil || len(cmd.Env) == 0 {
         env = os.Environ()
     } else {
-        env = r.command.Env
+        env = cmd.Env
     }
     // 3.set HOME
     if r.homeDir != "" {
         homeEnv := fmt.Sprintf("HOME=%s", r.homeDir)
         env = append(env, homeEnv)
     }
-    r.command.Env = env
+    cmd.Env = env
     // 4.set user
     if r.user != "" {
         uid, gid, groups, err := getUserCredentials(r.user)
         if err != nil {
             return err
         }
-        if r.command.SysProcAttr == nil {
-            r.command.SysProcAttr = &syscall.SysProcAttr{}
+        if cmd.SysProcAttr == nil {
+            cmd.SysProcAttr = &syscall.SysProcAttr{}
         }
-        r.command.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid, Groups: groups, NoSetGroups: false}
+        cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid, Groups: groups, NoSetGroups: false}
     }
 
     return nil
@@ -116,3 +122,35 @@ func getUserCredentials(sessionUser string) (uint32, uint32, []uint32, error) {
 func (r *Runner) removeCredential () error {
     return nil
 }
+
+// signalProcessGroup sends sig to all processes in the process group of cmd, or to the process if it has no own group
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+    if cmd == nil || cmd.Process == nil {
+        return nil
+    }
+    if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+        if err := syscall.Kill(-cmd.Process.Pid, sig); err == nil {
+            return nil
+        }
+    }
+    return cmd.Process.Signal(sig)
+}
+
+// killProcessGroup kills the command process and all processes in its process group
+func killProcessGroup(cmd *exec.Cmd) error {
+    return signalProcessGroup(cmd, syscall.SIGKILL)
+}
+
+// resourceUsage returns the resource usage of an exited process
+func resourceUsage(state *os.ProcessState) ResourceUsage {
+    rusage, ok := state.SysUsage().(*syscall.Rusage)
+    if !ok || rusage == nil {
+        return ResourceUsage{}
+    }
+    return ResourceUsage{
+        UserTime: time.Duration(rusage.Utime.Nano()),
+        SystemTime: time.Duration(rusage.Stime.Nano()),
+        // ru_maxrss is in kilobytes on linux
+        MaxRSS: unit.Bytes(rusage.Maxrss) * unit.KB,
+    }
+}
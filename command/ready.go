@@ -0,0 +1,240 @@
+package command
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "os"
+    "regexp"
+    "sync"
+    "time"
+
+    "github.com/gaodb1210/go-common/util/unit"
+)
+
+const (
+    // ProbeTCP is ready when Target, a host:port address, accepts TCP connections
+    ProbeTCP int = iota
+    // ProbeUnixSocket is ready when Target, a path, is a Unix domain socket
+    ProbeUnixSocket
+    // ProbeFile is ready when the file Target exists
+    ProbeFile
+    // ProbeLog is ready when a line of stdout or stderr matches the regexp Target
+    ProbeLog
+    // ProbeHTTP is ready when a GET of the URL Target returns 200
+    ProbeHTTP
+)
+
+const (
+    defaultProbeTimeout = 30 * time.Second
+    defaultProbeInterval = 100 * time.Millisecond
+    defaultReadyTailSize = 4 * unit.KB
+    maxProbeLineSize = 64 * 1024
+)
+
+var (
+    ErrProbeTimeout = errors.New("command is not ready within the probe timeout")
+    ErrExitedBeforeReady = errors.New("command exited before it is ready")
+)
+
+// Probe checks whether a started service is ready
+type Probe struct {
+    // Type is one of ProbeTCP, ProbeUnixSocket, ProbeFile, ProbeLog and ProbeHTTP
+    Type int
+    // Target is the address, path, regexp or URL checked, depending on Type
+    Target string
+    // Timeout is the max wait for the service to be ready, zero means 30s
+    Timeout time.Duration
+    // Interval is the polling interval, zero means 100ms
+    Interval time.Duration
+}
+
+// NotReadyError is returned when a command does not become ready, Result holds its exit code and output tail
+type NotReadyError struct {
+    Err error
+    Result *Result
+}
+
+func (e *NotReadyError) Error() string {
+    return fmt.Sprintf("%v: exit code %d, output: %s", e.Err, e.Result.ExitCode, e.Result.OutputTail)
+}
+
+func (e *NotReadyError) Unwrap() error {
+    return e.Err
+}
+
+// StartAndWaitReady starts the command described by spec, and waits until probe reports it ready.
+// If the command exits first, or is not ready within the probe timeout, the command is stopped
+// and a *NotReadyError with the output tail is returned.
+func (r *Runner) StartAndWaitReady(ctx context.Context, spec Spec, probe Probe) (*Execution, error) {
+    if probe.Timeout <= 0 {
+        probe.Timeout = defaultProbeTimeout
+    }
+    if probe.Interval <= 0 {
+        probe.Interval = defaultProbeInterval
+    }
+    var matcher *lineMatcher
+    if probe.Type == ProbeLog {
+        re, err := regexp.Compile(probe.Target)
+        if err != nil {
+            return nil, err
+        }
+        matcher = newLineMatcher(re)
+        spec.Stdout, spec.Stderr = wrapOutput(spec.Stdout, spec.Stderr, matcher.tee)
+    }
+    if r.tailSize() == 0 {
+        // keep the output tail to report why the command is not ready
+        r = r.Clone()
+        r.outputTailSize = defaultReadyTailSize
+    }
+    e, err := r.Start(ctx, spec)
+    if err != nil {
+        return nil, err
+    }
+
+    deadline := time.NewTimer(probe.Timeout)
+    defer deadline.Stop()
+    ticker := time.NewTicker(probe.Interval)
+    defer ticker.Stop()
+    // every check runs in the background and is limited to the probe interval,
+    // so a hung check does not delay noticing the command exit
+    var matched <-chan struct{}
+    var checked chan bool
+    cancelCheck := func() {}
+    defer func() {
+        cancelCheck()
+    }()
+    startCheck := func() {
+        var checkCtx context.Context
+        checkCtx, cancelCheck = context.WithTimeout(ctx, probe.Interval)
+        checked = make(chan bool, 1)
+        go func(checked chan<- bool) {
+            checked <- probe.check(checkCtx)
+        }(checked)
+    }
+    if matcher != nil {
+        matched = matcher.matched
+    } else {
+        startCheck()
+    }
+    for {
+        select {
+        case <-matched:
+            return e, nil
+        case ready := <-checked:
+            cancelCheck()
+            if ready {
+                return e, nil
+            }
+            checked = nil
+        case <-ticker.C:
+            if matcher == nil && checked == nil {
+                startCheck()
+            }
+        case <-e.Done():
+            result, _ := e.Wait()
+            return nil, &NotReadyError{Err: ErrExitedBeforeReady, Result: result}
+        case <-deadline.C:
+            fmt.Printf("command: %s is not ready within %s, stop it\n", e.name, probe.Timeout)
+            e.Cancel()
+            result, _ := e.Wait()
+            return nil, &NotReadyError{Err: ErrProbeTimeout, Result: result}
+        }
+    }
+}
+
+// check polls the probe once, ProbeLog is not polled
+func (p *Probe) check(ctx context.Context) bool {
+    switch p.Type {
+    case ProbeTCP:
+        dialer := net.Dialer{Timeout: p.Interval}
+        conn, err := dialer.DialContext(ctx, "tcp", p.Target)
+        if err != nil {
+            return false
+        }
+        _ = conn.Close()
+        return true
+    case ProbeUnixSocket:
+        info, err := os.Stat(p.Target)
+        return err == nil && info.Mode()&os.ModeSocket != 0
+    case ProbeFile:
+        _, err := os.Stat(p.Target)
+        return err == nil
+    case ProbeHTTP:
+        request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Target, nil)
+        if err != nil {
+            return false
+        }
+        response, err := http.DefaultClient.Do(request)
+        if err != nil {
+            return false
+        }
+        _, _ = io.Copy(ioutil.Discard, response.Body)
+        _ = response.Body.Close()
+        return response.StatusCode == http.StatusOK
+    }
+    return false
+}
+
+// lineMatcher closes matched once a complete line written by any stream matches the regexp
+type lineMatcher struct {
+    re *regexp.Regexp
+    once sync.Once
+    matched chan struct{}
+}
+
+func newLineMatcher(re *regexp.Regexp) *lineMatcher {
+    return &lineMatcher{re: re, matched: make(chan struct{})}
+}
+
+// tee returns a writer which writes to w and matches the lines, a nil w only matches
+func (m *lineMatcher) tee(w io.Writer) io.Writer {
+    lw := &lineMatchWriter{matcher: m}
+    if w == nil {
+        return lw
+    }
+    return io.MultiWriter(lw, w)
+}
+
+func (m *lineMatcher) match(line []byte) {
+    if m.re.Match(line) {
+        m.once.Do(func() {
+            close(m.matched)
+        })
+    }
+}
+
+// lineMatchWriter splits the output of one stream into lines
+type lineMatchWriter struct {
+    matcher *lineMatcher
+    mu sync.Mutex
+    line []byte
+}
+
+func (w *lineMatchWriter) Write(p []byte) (int, error) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    data := p
+    for len(data) > 0 {
+        i := bytes.IndexByte(data, '\n')
+        if i < 0 {
+            w.line = append(w.line, data...)
+            if len(w.line) > maxProbeLineSize {
+                // match and drop an overlong line
+                w.matcher.match(w.line)
+                w.line = w.line[:0]
+            }
+            break
+        }
+        w.line = append(w.line, data[:i]...)
+        w.matcher.match(bytes.TrimSuffix(w.line, []byte{'\r'}))
+        w.line = w.line[:0]
+        data = data[i+1:]
+    }
+    return len(p), nil
+}
@@ -0,0 +1,95 @@
+package command
+
+import (
+    "context"
+    "errors"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestRunner_StartAndWaitReady(t *testing.T) {
+    dir, err := ioutil.TempDir("", "ready")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    readyFile := filepath.Join(dir, "ready")
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+    defer server.Close()
+
+    r := newRunner()
+    for _, c := range []struct {
+        script string
+        probe Probe
+    }{
+        {"sleep 0.2; echo started; echo listening on 8080; sleep 10", Probe{Type: ProbeLog, Target: `^listening on \d+$`}},
+        {"sleep 0.2; touch " + readyFile + "; sleep 10", Probe{Type: ProbeFile, Target: readyFile}},
+        {"sleep 10", Probe{Type: ProbeTCP, Target: listener.Addr().String()}},
+        {"sleep 10", Probe{Type: ProbeHTTP, Target: server.URL}},
+    } {
+        start := time.Now()
+        e, err := r.StartAndWaitReady(context.Background(), Spec{Name: "sh", Args: []string{"-c", c.script}}, c.probe)
+        if err != nil {
+            t.Fatalf("probe %d: %v", c.probe.Type, err)
+        }
+        if e.State() != StateRunning || time.Since(start) > 2*time.Second {
+            t.Errorf("probe %d: unexpected ready state", c.probe.Type)
+        }
+        e.Cancel()
+        _, _ = e.Wait()
+    }
+}
+
+func TestRunner_StartAndWaitReady_Fail(t *testing.T) {
+    r := newRunner()
+    start := time.Now()
+    _, err := r.StartAndWaitReady(context.Background(), Spec{
+        Name: "sh",
+        Args: []string{"-c", "echo bind: address already in use >&2; exit 2"},
+    }, Probe{Type: ProbeTCP, Target: "127.0.0.1:1", Timeout: 5 * time.Second})
+    var notReady *NotReadyError
+    if !errors.Is(err, ErrExitedBeforeReady) || !errors.As(err, &notReady) || time.Since(start) > 2*time.Second {
+        t.Fatalf("expect %v immediately, got %v", ErrExitedBeforeReady, err)
+    }
+    if notReady.Result.ExitCode != 2 || !strings.Contains(notReady.Result.OutputTail, "address already in use") {
+        t.Errorf("unexpected result: %+v", notReady.Result)
+    }
+
+    _, err = r.StartAndWaitReady(context.Background(), Spec{Name: "sleep", Args: []string{"10"}},
+        Probe{Type: ProbeUnixSocket, Target: "/nonexistent.sock", Timeout: 300 * time.Millisecond})
+    if !errors.Is(err, ErrProbeTimeout) || !errors.As(err, &notReady) || notReady.Result.Status != Canceled {
+        t.Errorf("expect %v, got %v", ErrProbeTimeout, err)
+    }
+}
+
+func TestRunner_StartAndWaitReady_HungHTTP(t *testing.T) {
+    hung := make(chan struct{})
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        select {
+        case <-hung:
+        case <-r.Context().Done():
+        }
+    }))
+    defer server.Close()
+    defer close(hung)
+
+    r := newRunner()
+    start := time.Now()
+    _, err := r.StartAndWaitReady(context.Background(), Spec{Name: "sh", Args: []string{"-c", "sleep 0.3; exit 2"}},
+        Probe{Type: ProbeHTTP, Target: server.URL, Timeout: 10 * time.Second, Interval: 200 * time.Millisecond})
+    if !errors.Is(err, ErrExitedBeforeReady) || time.Since(start) > 2*time.Second {
+        t.Fatalf("expect %v soon after the exit, got %v after %s", ErrExitedBeforeReady, err, time.Since(start))
+    }
+}
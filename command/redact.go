@@ -0,0 +1,230 @@
+package command
+
+import (
+    "bytes"
+    "io"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+)
+
+const (
+    redactedMask = "******"
+    // redactLookbehindSize is how many bytes are held back for secret patterns split across writes
+    redactLookbehindSize = 128
+)
+
+// redactor masks registered secrets in strings and output streams
+type redactor struct {
+    literals []string
+    patterns []*regexp.Regexp
+}
+
+func (r *redactor) addSecret(secret string) {
+    if secret == "" {
+        return
+    }
+    r.literals = append(r.literals, secret)
+}
+
+func (r *redactor) addPattern(pattern *regexp.Regexp) {
+    r.patterns = append(r.patterns, pattern)
+}
+
+// clone returns a copy which does not share the secrets with r
+func (r *redactor) clone() redactor {
+    return redactor{
+        literals: append([]string(nil), r.literals...),
+        patterns: append([]*regexp.Regexp(nil), r.patterns...),
+    }
+}
+
+func (r *redactor) enabled() bool {
+    return len(r.literals) > 0 || len(r.patterns) > 0
+}
+
+// String returns s with all secrets masked
+func (r *redactor) String(s string) string {
+    if !r.enabled() {
+        return s
+    }
+    return string(r.mask([]byte(s), r.matches([]byte(s))))
+}
+
+// Strings returns a copy of ss with all secrets masked
+func (r *redactor) Strings(ss []string) []string {
+    if ss == nil {
+        return nil
+    }
+    masked := make([]string, len(ss))
+    for i, s := range ss {
+        masked[i] = r.String(s)
+    }
+    return masked
+}
+
+// maskError returns err with all secrets masked in its message, errors.Is and errors.As still see err
+func (r *redactor) maskError(err error) error {
+    if err == nil || !r.enabled() {
+        return err
+    }
+    msg := r.String(err.Error())
+    if msg == err.Error() {
+        return err
+    }
+    return &redactedError{err: err, msg: msg}
+}
+
+// redactedError replaces the message of an error which contains secrets
+type redactedError struct {
+    err error
+    msg string
+}
+
+func (e *redactedError) Error() string {
+    return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+    return e.err
+}
+
+// redactArgs returns the command line with all secrets masked, for logging
+func (r *redactor) redactArgs(name string, args []string) string {
+    return strings.Join(append([]string{r.String(name)}, r.Strings(args)...), " ")
+}
+
+// lookbehind returns how many trailing bytes may be the beginning of a secret
+func (r *redactor) lookbehind() int {
+    size := 0
+    if len(r.patterns) > 0 {
+        size = redactLookbehindSize
+    }
+    for _, literal := range r.literals {
+        if len(literal)-1 > size {
+            size = len(literal) - 1
+        }
+    }
+    return size
+}
+
+// matches returns the sorted and merged ranges of all secrets in b
+func (r *redactor) matches(b []byte) [][2]int {
+    var ranges [][2]int
+    for _, literal := range r.literals {
+        for offset := 0; ; {
+            i := bytes.Index(b[offset:], []byte(literal))
+            if i < 0 {
+                break
+            }
+            ranges = append(ranges, [2]int{offset + i, offset + i + len(literal)})
+            offset += i + len(literal)
+        }
+    }
+    for _, pattern := range r.patterns {
+        for _, loc := range pattern.FindAllIndex(b, -1) {
+            if loc[1] > loc[0] {
+                ranges = append(ranges, [2]int{loc[0], loc[1]})
+            }
+        }
+    }
+    if len(ranges) < 2 {
+        return ranges
+    }
+    sort.Slice(ranges, func(i, j int) bool {
+        return ranges[i][0] < ranges[j][0]
+    })
+    merged := ranges[:1]
+    for _, rg := range ranges[1:] {
+        last := &merged[len(merged)-1]
+        if rg[0] <= last[1] {
+            if rg[1] > last[1] {
+                last[1] = rg[1]
+            }
+            continue
+        }
+        merged = append(merged, rg)
+    }
+    return merged
+}
+
+// mask replaces the ranges of b with redactedMask
+func (r *redactor) mask(b []byte, ranges [][2]int) []byte {
+    if len(ranges) == 0 {
+        return b
+    }
+    var masked bytes.Buffer
+    last := 0
+    for _, rg := range ranges {
+        masked.Write(b[last:rg[0]])
+        masked.WriteString(redactedMask)
+        last = rg[1]
+    }
+    masked.Write(b[last:])
+    return masked.Bytes()
+}
+
+// wrap returns a writer which masks secrets before writing to w, it must be flushed after the last write
+func (r *redactor) wrap(w io.Writer) *redactWriter {
+    return &redactWriter{redactor: r, w: w, lookbehind: r.lookbehind()}
+}
+
+// redactWriter holds back the trailing bytes of every write, which may be the beginning of a secret
+type redactWriter struct {
+    mu sync.Mutex
+    redactor *redactor
+    w io.Writer
+    lookbehind int
+    pending []byte
+    closed bool
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    data := append(w.pending, p...)
+    ranges := w.redactor.matches(data)
+    // 1. hold back the lookbehind, and any secret crossing it
+    safe := len(data)
+    if !w.closed {
+        safe -= w.lookbehind
+        if safe < 0 {
+            safe = 0
+        }
+    }
+    emit := ranges[:0:0]
+    for _, rg := range ranges {
+        if rg[1] <= safe {
+            emit = append(emit, rg)
+            continue
+        }
+        if rg[0] < safe {
+            safe = rg[0]
+        }
+        break
+    }
+    // 2. write the masked data before the safe boundary
+    w.pending = append([]byte(nil), data[safe:]...)
+    if safe == 0 {
+        return len(p), nil
+    }
+    if _, err := w.w.Write(w.redactor.mask(data[:safe], emit)); err != nil {
+        return 0, err
+    }
+    return len(p), nil
+}
+
+// flush writes the held back bytes, later writes are masked without holding back
+func (w *redactWriter) flush() error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    w.closed = true
+    if len(w.pending) == 0 {
+        return nil
+    }
+    data := w.pending
+    w.pending = nil
+    _, err := w.w.Write(w.redactor.mask(data, w.redactor.matches(data)))
+    return err
+}
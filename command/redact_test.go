@@ -0,0 +1,90 @@
+package command
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "os"
+    "os/exec"
+    "regexp"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestRedactWriter_SplitSecret(t *testing.T) {
+    r := &redactor{}
+    r.addSecret("s3cr3t-value")
+    r.addPattern(regexp.MustCompile(`token=[0-9a-f]+`))
+    output := bytes.NewBufferString("")
+    w := r.wrap(output)
+    for _, chunk := range []string{"user s3c", "r3t-va", "lue login, tok", "en=00ff", "ee done"} {
+        _, _ = w.Write([]byte(chunk))
+    }
+    if err := w.flush(); err != nil {
+        t.Fatal(err)
+    }
+    expected := "user ****** login, ****** done"
+    if output.String() != expected {
+        t.Errorf("expect %q, got %q", expected, output.String())
+    }
+}
+
+func TestRunner_RunRedact(t *testing.T) {
+    r := newRunner()
+    r.AddSecret("hunter2")
+    output := bytes.NewBufferString("")
+    result, err := r.Run(context.Background(), Spec{
+        Name: "sh",
+        Args: []string{"-c", "echo password=$PASSWORD", "hunter2"},
+        Env: []string{"PASSWORD=hunter2"},
+        Stdout: output,
+        Stderr: output,
+        Timeout: 2 * time.Second,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if strings.Contains(output.String(), "hunter2") || !strings.Contains(output.String(), "password=******") {
+        t.Errorf("secret is not masked in output: %q", output.String())
+    }
+    if result.Args[2] != redactedMask || result.Env[0] != "PASSWORD="+redactedMask {
+        t.Errorf("secret is not masked in result: %v %v", result.Args, result.Env)
+    }
+}
+
+func TestRunner_RunRedactError(t *testing.T) {
+    r := newRunner()
+    r.AddSecret("hunter2")
+    _, err := r.Run(context.Background(), Spec{Name: "/nonexistent/hunter2"})
+    if err == nil || strings.Contains(err.Error(), "hunter2") {
+        t.Errorf("secret is not masked in error: %v", err)
+    }
+    var pathErr *os.PathError
+    if !errors.As(err, &pathErr) {
+        t.Errorf("expect the original error to be wrapped, got %T", err)
+    }
+    _, err = r.Run(context.Background(), Spec{Name: "hunter2-not-found"})
+    if !errors.Is(err, exec.ErrNotFound) || strings.Contains(err.Error(), "hunter2") {
+        t.Errorf("unexpected error: %v", err)
+    }
+}
+
+func TestRunner_CloneSecrets(t *testing.T) {
+    r := newRunner()
+    for _, secret := range []string{"first", "1st", "one"} {
+        r.AddSecret(secret)
+    }
+    clone := r.Clone()
+    clone.AddSecret("second")
+    r.AddSecret("third")
+    if clone.secrets.String("second") != redactedMask || clone.secrets.String("third") != "third" {
+        t.Error("the secrets of the clone are overwritten by the runner")
+    }
+    if r.secrets.String("third") != redactedMask || r.secrets.String("second") != "second" {
+        t.Error("the secrets of the runner are overwritten by the clone")
+    }
+    if clone.secrets.String("first") != redactedMask {
+        t.Error("clone lost the secrets of the runner")
+    }
+}
@@ -0,0 +1,125 @@
+package command
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math"
+    "math/rand"
+    "time"
+)
+
+const defaultBackoffMultiplier = 2
+
+// RetryPolicy decides whether and when a failed command is run again
+type RetryPolicy struct {
+    // MaxAttempts is the max number of executions including the first one, less than 2 means no retry
+    MaxAttempts int
+    // InitialBackoff is the wait before the second attempt
+    InitialBackoff time.Duration
+    // MaxBackoff caps the wait between attempts, zero means no cap
+    MaxBackoff time.Duration
+    // Multiplier grows the backoff after every attempt, zero means 2
+    Multiplier float64
+    // Jitter randomizes each backoff by up to this fraction of it, between 0 and 1
+    Jitter float64
+    // RetryExitCodes retries a command which exits with one of these codes
+    RetryExitCodes []int
+    // RetryOnTimeout retries a command which times out or idle times out
+    RetryOnTimeout bool
+    // RetryOnStartFailure retries a command which fails to start, a command denied by the policy is never retried
+    RetryOnStartFailure bool
+    // RetryIf retries a command when it returns true, it is not asked for a command which fails to start
+    RetryIf func(result *Result) bool
+}
+
+// Attempt records one execution of a command
+type Attempt struct {
+    Number int
+    ExitCode int
+    Status int
+    StartTime time.Time
+    Duration time.Duration
+}
+
+// shouldRetry reports whether the attempt which produced result and err should be retried
+func (p RetryPolicy) shouldRetry(result *Result, err error) bool {
+    if len(result.Attempts) >= p.MaxAttempts || result.Status == Canceled || errors.Is(err, ErrPolicyDenied) {
+        return false
+    }
+    if result.Status == Fail {
+        return p.RetryOnStartFailure
+    }
+    if p.RetryOnTimeout && (result.Status == Timeout || result.Status == IdleTimeout) {
+        return true
+    }
+    if result.Status == Success {
+        for _, code := range p.RetryExitCodes {
+            if result.ExitCode == code {
+                return true
+            }
+        }
+    }
+    return p.RetryIf != nil && p.RetryIf(result)
+}
+
+// backoff returns the wait after the given attempt number
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+    multiplier := p.Multiplier
+    if multiplier <= 0 {
+        multiplier = defaultBackoffMultiplier
+    }
+    // the growth stops at the cap, without a cap at the max duration, so it does not overflow
+    limit := float64(math.MaxInt64)
+    if p.MaxBackoff > 0 {
+        limit = float64(p.MaxBackoff)
+    }
+    backoff := float64(p.InitialBackoff)
+    for i := 1; i < attempt && backoff < limit; i++ {
+        backoff *= multiplier
+    }
+    if backoff > limit {
+        backoff = limit
+    }
+    if p.Jitter > 0 {
+        backoff += backoff * p.Jitter * (2*rand.Float64() - 1)
+    }
+    // the jitter does not exceed the cap either
+    if backoff > limit {
+        backoff = limit
+    }
+    // float64(math.MaxInt64) rounds up out of the range of a duration
+    if backoff >= float64(math.MaxInt64) {
+        return time.Duration(math.MaxInt64)
+    }
+    return time.Duration(backoff)
+}
+
+// runWithRetry runs spec until it succeeds, the retry policy gives up or ctx is done
+func (r *Runner) runWithRetry(ctx context.Context, spec Spec) (*Result, error) {
+    var attempts []Attempt
+    for {
+        result, err := r.run(ctx, spec)
+        attempts = append(attempts, Attempt{
+            Number: len(attempts) + 1,
+            ExitCode: result.ExitCode,
+            Status: result.Status,
+            StartTime: result.StartTime,
+            Duration: result.Duration(),
+        })
+        result.Attempts = attempts
+        if !r.retryPolicy.shouldRetry(result, err) {
+            return result, err
+        }
+        backoff := r.retryPolicy.backoff(len(attempts))
+        fmt.Printf("command: %s attempt %d failed, retry after %s\n", result.Name, len(attempts), backoff)
+        timer := time.NewTimer(backoff)
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            timer.Stop()
+            result.Status = Canceled
+            return result, ctx.Err()
+        }
+    }
+}
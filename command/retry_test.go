@@ -0,0 +1,103 @@
+package command
+
+import (
+    "context"
+    "errors"
+    "io/ioutil"
+    "math"
+    "os"
+    "testing"
+    "time"
+)
+
+func TestRunner_RetryPolicy(t *testing.T) {
+    f, err := ioutil.TempFile("", "retry")
+    if err != nil {
+        t.Fatal(err)
+    }
+    _ = f.Close()
+    defer os.Remove(f.Name())
+
+    r := newRunner()
+    r.SetRetryPolicy(RetryPolicy{
+        MaxAttempts: 5,
+        InitialBackoff: 10 * time.Millisecond,
+        Jitter: 0.5,
+        RetryExitCodes: []int{3},
+    })
+    // exit 3 until the counter file has three lines
+    result, err := r.Run(context.Background(), Spec{
+        Name: "sh",
+        Args: []string{"-c", "echo x >> " + f.Name() + "; [ $(wc -l < " + f.Name() + ") -ge 3 ] || exit 3"},
+        Timeout: 2 * time.Second,
+    })
+    if err != nil || result.ExitCode != 0 {
+        t.Fatalf("expect success, got exit code %d err %v", result.ExitCode, err)
+    }
+    if len(result.Attempts) != 3 || result.Attempts[0].ExitCode != 3 || result.Attempts[2].Number != 3 {
+        t.Errorf("unexpected attempts: %+v", result.Attempts)
+    }
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+    p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+    expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+    for i, d := range expected {
+        if backoff := p.backoff(i + 1); backoff != d {
+            t.Errorf("attempt %d: expect backoff %s, got %s", i+1, d, backoff)
+        }
+    }
+}
+
+func TestRetryPolicy_BackoffJitterCap(t *testing.T) {
+    p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 2 * time.Second, Jitter: 1}
+    for i := 0; i < 100; i++ {
+        if backoff := p.backoff(3); backoff > p.MaxBackoff {
+            t.Fatalf("backoff %s exceeds the cap %s", backoff, p.MaxBackoff)
+        }
+    }
+}
+
+func TestRetryPolicy_BackoffOverflow(t *testing.T) {
+    p := RetryPolicy{InitialBackoff: time.Second}
+    last := time.Duration(0)
+    for attempt := 1; attempt <= 100; attempt++ {
+        backoff := p.backoff(attempt)
+        if backoff < last {
+            t.Fatalf("attempt %d: backoff %s is less than %s", attempt, backoff, last)
+        }
+        last = backoff
+    }
+    if last != time.Duration(math.MaxInt64) {
+        t.Errorf("expect the max duration, got %s", last)
+    }
+}
+
+func TestRunner_RetryStartFailure(t *testing.T) {
+    r := newRunner()
+    retried := 0
+    r.SetRetryPolicy(RetryPolicy{
+        MaxAttempts: 3,
+        RetryIf: func(result *Result) bool {
+            retried++
+            return true
+        },
+    })
+    // a start failure is not retried by default
+    result, err := r.Run(context.Background(), Spec{Name: "/nonexistent/command"})
+    if err == nil || len(result.Attempts) != 1 || retried != 0 {
+        t.Errorf("expect one attempt, got %d attempts, err %v", len(result.Attempts), err)
+    }
+    // a policy denial is never retried
+    r.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, RetryOnStartFailure: true})
+    r.SetPolicy(&Policy{})
+    result, err = r.Run(context.Background(), Spec{Name: "sh"})
+    if !errors.Is(err, ErrPolicyDenied) || len(result.Attempts) != 1 {
+        t.Errorf("expect one denied attempt, got %d attempts, err %v", len(result.Attempts), err)
+    }
+    r.SetPolicy(nil)
+    result, err = r.Run(context.Background(), Spec{Name: "/nonexistent/command"})
+    if err == nil || len(result.Attempts) != 3 {
+        t.Errorf("expect 3 attempts with RetryOnStartFailure, got %d attempts, err %v", len(result.Attempts), err)
+    }
+}
@@ -1,30 +1,104 @@
 package command
 
 import (
+    "context"
     "fmt"
     "io"
+    "os"
     "os/exec"
+    "regexp"
+    "sync"
     "time"
+
+    "github.com/gaodb1210/go-common/util/unit"
 )
 
+// Runner runs commands with its config, configure it with the setters before sharing it across goroutines,
+// every run owns its own state
 type Runner struct {
-    command         *exec.Cmd
+    runnerConfig
+
+    // runsMu guards runs, the running commands of the runner and the funcs to cancel them
+    runsMu sync.Mutex
+    runs map[*exec.Cmd]func()
+}
+
+// runnerConfig is the config of a Runner set by the setters, Clone copies it
+type runnerConfig struct {
     user            string
     password        string
     homeDir         string
+    idleTimeout     time.Duration
+    heartbeatFile   string
+    outputLimit     OutputLimit
+    secrets         redactor
+    retryPolicy     RetryPolicy
+    forwarder       *SignalForwarder
+    history         *HistoryStore
+    outputTailSize  unit.Bytes
+    policy          *Policy
+    metrics         Metrics
+    chroot          string
+    umask           os.FileMode
+    umaskSet        bool
+    createDir       bool
+    privateTmp      bool
 }
 
 func newRunner() *Runner {
     return &Runner{}
 }
 
-// Cancel cancel running command
+// Clone returns a copy of the runner config, the copy does not share the running commands
+func (r *Runner) Clone() *Runner {
+    c := &Runner{runnerConfig: r.runnerConfig}
+    c.secrets = r.secrets.clone()
+    return c
+}
+
+// Cancel kills all running commands of the runner immediately
 func (r *Runner) Cancel() {
-    if r.command != nil {
-        _ = r.command.Process.Kill()
+    for cmd := range r.runningCommands() {
+        _ = killProcessGroup(cmd)
+    }
+}
+
+// CancelAll cancels all running commands of the runner like their context is done,
+// they are stopped gracefully within Spec.StopTimeout
+func (r *Runner) CancelAll() {
+    for _, cancel := range r.runningCommands() {
+        cancel()
     }
 }
 
+// addRun registers a running command and the func to cancel it
+func (r *Runner) addRun(cmd *exec.Cmd, cancel func()) {
+    r.runsMu.Lock()
+    defer r.runsMu.Unlock()
+    if r.runs == nil {
+        r.runs = make(map[*exec.Cmd]func())
+    }
+    r.runs[cmd] = cancel
+}
+
+// removeRun unregisters a finished command
+func (r *Runner) removeRun(cmd *exec.Cmd) {
+    r.runsMu.Lock()
+    defer r.runsMu.Unlock()
+    delete(r.runs, cmd)
+}
+
+// runningCommands returns a snapshot of the running commands of the runner
+func (r *Runner) runningCommands() map[*exec.Cmd]func() {
+    r.runsMu.Lock()
+    defer r.runsMu.Unlock()
+    runs := make(map[*exec.Cmd]func(), len(r.runs))
+    for cmd, cancel := range r.runs {
+        runs[cmd] = cancel
+    }
+    return runs
+}
+
 // SetUser set user
 func (r *Runner) SetUser(name string) {
     r.user = name
@@ -40,36 +114,81 @@ func (r *Runner) SetHomeDir(homeDir string) {
     r.homeDir = homeDir
 }
 
-// SyncRunSimple sync run command, ignore output
-func (r *Runner)  SyncRunSimple(commandName string, commandArguments []string, timeOut int) error {
-    
-    // 1. init command
-    r.command = exec.Command(commandName, commandArguments...)
-    if err := r.preProcess(); err != nil {
+// SetIdleTimeout set the time limit without any output, zero means no limit
+func (r *Runner) SetIdleTimeout(idleTimeout time.Duration) {
+    r.idleTimeout = idleTimeout
+}
+
+// SetHeartbeatFile set a file whose mtime counts as command activity for the idle timeout
+func (r *Runner) SetHeartbeatFile(heartbeatFile string) {
+    r.heartbeatFile = heartbeatFile
+}
+
+// SetOutputLimit set the output size limits and truncate policy
+func (r *Runner) SetOutputLimit(outputLimit OutputLimit) {
+    r.outputLimit = outputLimit
+}
+
+// AddSecret register a secret value, which is masked in logs, results and command output
+func (r *Runner) AddSecret(secret string) {
+    r.secrets.addSecret(secret)
+}
+
+// AddSecretPattern register a secret regexp pattern, which is masked in logs, results and command output
+func (r *Runner) AddSecretPattern(pattern string) error {
+    re, err := regexp.Compile(pattern)
+    if err != nil {
         return err
     }
-    // 2.start command
-    if err := r.command.Start(); err != nil {
-        fmt.Printf("start command error:%s\n", err.Error())
+    r.secrets.addPattern(re)
+    return nil
+}
+
+// SetRetryPolicy set the policy to retry failed commands
+func (r *Runner) SetRetryPolicy(retryPolicy RetryPolicy) {
+    r.retryPolicy = retryPolicy
+}
+
+// SetSignalForwarder set the forwarder which relays signals received by this process to the running commands
+func (r *Runner) SetSignalForwarder(forwarder *SignalForwarder) {
+    r.forwarder = forwarder
+}
+
+// SetHistoryStore set the store which records every execution
+func (r *Runner) SetHistoryStore(history *HistoryStore) {
+    r.history = history
+}
+
+// SetOutputTailSize set the size of the output tail kept in Result.OutputTail, zero means do not keep it
+func (r *Runner) SetOutputTailSize(outputTailSize unit.Bytes) {
+    r.outputTailSize = outputTailSize
+}
+
+// SetPolicy set the policy checked before every command starts, nil means no check
+func (r *Runner) SetPolicy(policy *Policy) {
+    r.policy = policy
+}
+
+// SetMetrics set the metrics which measure every command
+func (r *Runner) SetMetrics(metrics Metrics) {
+    r.metrics = metrics
+}
+
+// SyncRunSimple sync run command, ignore output
+func (r *Runner) SyncRunSimple(commandName string, commandArguments []string, timeOut int) error {
+    result, err := r.Run(context.Background(), Spec{
+        Name: commandName,
+        Args: commandArguments,
+        Timeout: syncTimeout(timeOut),
+    })
+    switch {
+    case err != nil && result.Status == Fail && !result.StartTime.IsZero():
+        // the command process failed to start
         return ErrCommandStart
-    }
-    // 3. create goroutine to wait command finish
-    finished := make(chan error, 1)
-    go func() {
-        finished <- r.command.Wait()
-    }()
-    // 4. wait command finish or timeout
-    var err error
-    select {
-    case err = <-finished:
-        fmt.Printf("command execute completed.")
-        if err != nil {
-            fmt.Printf("command execute error: %s", err.Error())
-        }
-    case <-time.After(time.Duration(timeOut) * time.Second):
-        fmt.Printf("command execute timeout.")
-        _ = r.command.Process.Kill()
-        err = ErrCommandTimeout
+    case err == nil && result.ExitCode != 0 && result.processState != nil:
+        // like exec.Cmd.Wait
+        err = &exec.ExitError{ProcessState: result.processState}
+        fmt.Printf("command execute error: %s\n", err)
     }
     return err
 }
@@ -83,61 +202,48 @@ func (r *Runner) SyncRun(
     stderrWriter io.Writer,
     timeOut int) (exitCode int, status int, err error) {
     
-    status = Success
-    exitCode = 0
-    // 1. init command
-    r.command = exec.Command(commandName, commandArguments...)
-    r.command.Stdout = stdoutWriter
-    r.command.Stderr = stderrWriter
-    r.command.Dir = workingDir
-    if err := r.preProcess(); err != nil {
-        return 0, Fail, err
+    result, err := r.Run(context.Background(), Spec{
+        Name: commandName,
+        Args: commandArguments,
+        Dir: workingDir,
+        Stdout: stdoutWriter,
+        Stderr: stderrWriter,
+        Timeout: syncTimeout(timeOut),
+    })
+    return result.ExitCode, result.Status, err
+}
+
+// syncTimeout converts the timeOut in seconds of the sync runs, zero or less times out at once
+func syncTimeout(timeOut int) time.Duration {
+    if timeOut <= 0 {
+        return time.Nanosecond
     }
+    return time.Duration(timeOut) * time.Second
+}
+
+// Run runs the command described by spec, and waits until it finishes, times out or ctx is done.
+// A failed command is run again according to the retry policy, all attempts write to the same output writers.
+func (r *Runner) Run(ctx context.Context, spec Spec) (*Result, error) {
+    return r.runWithRetry(ctx, spec)
+}
 
-    // 3. start command
-    if err = r.command.Start(); err != nil {
-        fmt.Printf("start command fail: %s\n", err)
-        exitCode = 1
-        return exitCode, Fail, err
+// checkPolicy checks spec against the policy, and logs the reason when it is denied
+func (r *Runner) checkPolicy(spec Spec) error {
+    if r.policy == nil {
+        return nil
     }
-    // 4. start goroutine to wait finish
-    finished := make(chan WaitProcessResult, 1)
-    go func() {
-        processState, err := r.command.Process.Wait()
-        finished <- WaitProcessResult{
-            processState: processState,
-            err: err,
-        }
-    }()
-    // 5. wait command execute finish or timeout
-    select {
-    case waitProcessResult := <-finished:
-        fmt.Printf("Command: %s execute completed\n", commandName)
-        if waitProcessResult.processState != nil {
-            if waitProcessResult.err != nil {
-                fmt.Printf("os.Process.Wait() returns error with valid process state\n")
-            }
-            
-            exitCode = waitProcessResult.processState.ExitCode()
-            // Sleep 200ms to allow remaining data to be copied back
-            time.Sleep(time.Duration(200) * time.Millisecond)
-            // Explicitly break select statement in case timer also times out
-            break
-        } else {
-            exitCode = 1
-            return exitCode, Fail, waitProcessResult.err
-        }
-    case <-time.After(time.Duration(timeOut) * time.Second):
-        fmt.Printf("command: %s execute timeout", commandName)
-        exitCode = 1
-        status = Timeout
-        err = ErrCommandTimeout
-        _ = r.command.Process.Kill()
+    err := r.policy.check(spec, r.user, r.chroot)
+    if err != nil {
+        fmt.Printf("%s\n", r.secrets.String(err.Error()))
     }
-    
-    if r.user != "" {
-        _ = r.removeCredential()
+    return err
+}
+
+// run runs the command described by spec once
+func (r *Runner) run(ctx context.Context, spec Spec) (*Result, error) {
+    e, err := r.start(ctx, spec)
+    if err != nil {
+        return e.result, r.secrets.maskError(err)
     }
-    
-    return exitCode, status, err
-}
\ No newline at end of file
+    return e.Wait()
+}
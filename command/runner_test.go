@@ -2,7 +2,13 @@ package command
 
 import (
     "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "os/exec"
+    "sync"
     "testing"
+    "time"
 )
 
 func TestRunner_SyncRunSimple(t *testing.T) {
@@ -13,6 +19,22 @@ func TestRunner_SyncRunSimple(t *testing.T) {
     }
 }
 
+func TestRunner_SyncRunSimpleErrors(t *testing.T) {
+    r := newRunner()
+    err := r.SyncRunSimple("sh", []string{"-c", "exit 3"}, 2)
+    var exitErr *exec.ExitError
+    if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+        t.Errorf("expect *exec.ExitError with code 3, got %v", err)
+    }
+    // zero times out at once
+    if err := r.SyncRunSimple("sleep", []string{"1"}, 0); err != ErrCommandTimeout {
+        t.Errorf("expect %v, got %v", ErrCommandTimeout, err)
+    }
+    if err := r.SyncRunSimple("/nonexistent/command", nil, 2); err != ErrCommandStart {
+        t.Errorf("expect %v, got %v", ErrCommandStart, err)
+    }
+}
+
 func TestRunner_SyncRun(t *testing.T) {
     r := newRunner()
     r.SetUser("gaodb")
@@ -21,4 +43,59 @@ func TestRunner_SyncRun(t *testing.T) {
     r.SyncRun("", "sh", []string{"-c", "ls -al ./*"},
     output, output, 2)
     println(string(output.Bytes()))
-}
\ No newline at end of file
+}
+
+func TestRunner_SyncRunZeroTimeout(t *testing.T) {
+    r := newRunner()
+    output := bytes.NewBufferString("")
+    // zero times out at once
+    exitCode, status, err := r.SyncRun("", "sh", []string{"-c", "sleep 1 && echo done"}, output, output, 0)
+    if err != ErrCommandTimeout || exitCode != 1 || status != Timeout || output.Len() != 0 {
+        t.Errorf("unexpected result %d, %d, %v, %q", exitCode, status, err, output.String())
+    }
+}
+
+func TestRunner_ConcurrentRuns(t *testing.T) {
+    r := newRunner()
+    r.Cancel()
+    var wg sync.WaitGroup
+    outputs := make([]bytes.Buffer, 8)
+    for i := range outputs {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            _, _, _ = r.SyncRun("", "sh", []string{"-c", fmt.Sprintf("echo %d", i)}, &outputs[i], &outputs[i], 2)
+        }(i)
+    }
+    wg.Wait()
+    for i := range outputs {
+        if outputs[i].String() != fmt.Sprintf("%d\n", i) {
+            t.Errorf("run %d: unexpected output %q", i, outputs[i].String())
+        }
+    }
+}
+
+func TestRunner_CancelAll(t *testing.T) {
+    r := newRunner()
+    results := make(chan *Result, 3)
+    for i := 0; i < cap(results); i++ {
+        go func() {
+            result, _ := r.Run(context.Background(), Spec{Name: "sleep", Args: []string{"10"}, StopTimeout: time.Second})
+            results <- result
+        }()
+    }
+    time.Sleep(200 * time.Millisecond)
+    other := r.Clone()
+    other.CancelAll()
+    r.CancelAll()
+    for i := 0; i < cap(results); i++ {
+        select {
+        case result := <-results:
+            if result.Status != Canceled {
+                t.Errorf("expect canceled, got status %d", result.Status)
+            }
+        case <-time.After(2 * time.Second):
+            t.Fatal("run is not canceled")
+        }
+    }
+}
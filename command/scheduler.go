@@ -0,0 +1,356 @@
+package command
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "math/rand"
+    "os"
+    "sync"
+    "time"
+)
+
+const (
+    // OverlapSkip skips an activation while the previous run is still running
+    OverlapSkip int = iota
+    // OverlapQueue runs an activation after the previous run finishes
+    OverlapQueue
+    // OverlapKill cancels the previous run and starts a new one
+    OverlapKill
+)
+
+const (
+    // CatchUpNone ignores the activations missed while the scheduler was down
+    CatchUpNone int = iota
+    // CatchUpOnce runs once at start when any activation was missed while the scheduler was down
+    CatchUpOnce
+    // CatchUpAll runs every activation missed while the scheduler was down, the oldest first and at most 100,
+    // the runs follow the overlap policy, so use OverlapQueue to run all of them one by one
+    CatchUpAll
+)
+
+const (
+    defaultCronHistorySize = 10
+    maxCronCatchUpRuns = 100
+)
+
+var (
+    ErrCronJobExists = errors.New("cron job already exists")
+    ErrCronJobNotFound = errors.New("cron job not found")
+)
+
+// CronJob describes a command run on a cron schedule
+type CronJob struct {
+    // Name identifies the job
+    Name string
+    // Schedule is a cron expression, see ParseCron
+    Schedule string
+    // Spec is the command to run
+    Spec Spec
+    // Overlap decides what to do when the previous run is still running, one of OverlapSkip, OverlapQueue and OverlapKill
+    Overlap int
+    // Jitter delays every activation by a random duration up to Jitter
+    Jitter time.Duration
+    // CatchUp decides what to do with the activations missed while the scheduler was down, it needs a state file
+    CatchUp int
+    // HistorySize is the number of recent runs kept, zero means 10
+    HistorySize int
+}
+
+// CronRun records one run of a cron job
+type CronRun struct {
+    Scheduled time.Time
+    Result *Result
+    Err error
+}
+
+// Scheduler runs commands on cron schedules
+type Scheduler struct {
+    runner *Runner
+    location *time.Location
+    stateFile string
+    mu sync.Mutex
+    entries map[string]*cronEntry
+    state map[string]time.Time
+    started bool
+    ctx context.Context
+    cancel context.CancelFunc
+}
+
+// NewScheduler creates a Scheduler which runs jobs with the config of runner, schedules without a time zone use loc
+func NewScheduler(runner *Runner, loc *time.Location) *Scheduler {
+    if runner == nil {
+        runner = newRunner()
+    }
+    if loc == nil {
+        loc = time.Local
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    return &Scheduler{
+        runner: runner.Clone(),
+        location: loc,
+        entries: make(map[string]*cronEntry),
+        state: make(map[string]time.Time),
+        ctx: ctx,
+        cancel: cancel,
+    }
+}
+
+// SetStateFile set the file which records the last activation of every job, used to catch up missed runs
+func (s *Scheduler) SetStateFile(stateFile string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.stateFile = stateFile
+    content, err := ioutil.ReadFile(stateFile)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(content, &s.state)
+}
+
+// Add adds a job, it is scheduled once the scheduler is started
+func (s *Scheduler) Add(job CronJob) error {
+    schedule, err := ParseCron(job.Schedule, s.location)
+    if err != nil {
+        return err
+    }
+    if job.HistorySize <= 0 {
+        job.HistorySize = defaultCronHistorySize
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.entries[job.Name]; ok {
+        return ErrCronJobExists
+    }
+    e := &cronEntry{
+        scheduler: s,
+        job: job,
+        schedule: schedule,
+        runner: s.runner.Clone(),
+        done: make(chan struct{}),
+    }
+    e.ctx, e.cancel = context.WithCancel(s.ctx)
+    s.entries[job.Name] = e
+    if s.started {
+        go e.loop()
+    }
+    return nil
+}
+
+// Remove removes a job, and cancels its running command
+func (s *Scheduler) Remove(name string) error {
+    s.mu.Lock()
+    e, ok := s.entries[name]
+    delete(s.entries, name)
+    started := s.started
+    s.mu.Unlock()
+    if !ok {
+        return ErrCronJobNotFound
+    }
+    e.cancel()
+    if started {
+        <-e.done
+    }
+    e.runs.Wait()
+    return nil
+}
+
+// Start starts scheduling all jobs
+func (s *Scheduler) Start() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.started {
+        return
+    }
+    s.started = true
+    for _, e := range s.entries {
+        go e.loop()
+    }
+}
+
+// Stop stops scheduling, cancels the running commands and waits for them to exit
+func (s *Scheduler) Stop() {
+    s.mu.Lock()
+    started := s.started
+    entries := make([]*cronEntry, 0, len(s.entries))
+    for _, e := range s.entries {
+        entries = append(entries, e)
+    }
+    s.mu.Unlock()
+    s.cancel()
+    for _, e := range entries {
+        if started {
+            <-e.done
+        }
+        e.runs.Wait()
+    }
+}
+
+// History returns the recent runs of a job, the oldest first
+func (s *Scheduler) History(name string) ([]CronRun, error) {
+    s.mu.Lock()
+    e, ok := s.entries[name]
+    s.mu.Unlock()
+    if !ok {
+        return nil, ErrCronJobNotFound
+    }
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    return append([]CronRun(nil), e.history...), nil
+}
+
+// NextRun returns the next activation of a job
+func (s *Scheduler) NextRun(name string) (time.Time, error) {
+    s.mu.Lock()
+    e, ok := s.entries[name]
+    s.mu.Unlock()
+    if !ok {
+        return time.Time{}, ErrCronJobNotFound
+    }
+    return e.schedule.Next(time.Now()), nil
+}
+
+// lastActivation returns the last recorded activation of a job
+func (s *Scheduler) lastActivation(name string) (time.Time, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    t, ok := s.state[name]
+    return t, ok
+}
+
+// recordActivation records and persists the last activation of a job
+func (s *Scheduler) recordActivation(name string, t time.Time) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.state[name] = t
+    if s.stateFile == "" {
+        return
+    }
+    content, err := json.Marshal(s.state)
+    if err != nil {
+        return
+    }
+    tmp := s.stateFile + ".tmp"
+    if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+        fmt.Printf("write cron state file %s error: %v\n", tmp, err)
+        return
+    }
+    if err := os.Rename(tmp, s.stateFile); err != nil {
+        fmt.Printf("rename cron state file %s error: %v\n", s.stateFile, err)
+    }
+}
+
+type cronEntry struct {
+    scheduler *Scheduler
+    job CronJob
+    schedule CronSchedule
+    runner *Runner
+    ctx context.Context
+    cancel context.CancelFunc
+    done chan struct{}
+
+    mu sync.Mutex
+    running bool
+    pending []time.Time
+    cancelRun context.CancelFunc
+    history []CronRun
+    runs sync.WaitGroup
+}
+
+// loop waits for every activation and triggers it
+func (e *cronEntry) loop() {
+    defer close(e.done)
+    now := time.Now()
+    // 1. catch up the activations missed while the scheduler was down
+    if last, ok := e.scheduler.lastActivation(e.job.Name); ok && e.job.CatchUp != CatchUpNone {
+        limit := maxCronCatchUpRuns
+        if e.job.CatchUp == CatchUpOnce {
+            limit = 1
+        }
+        missed := e.schedule.Next(last)
+        for n := 0; n < limit && !missed.IsZero() && missed.Before(now); n++ {
+            fmt.Printf("cron job: %s missed activation at %s, catch up\n", e.job.Name, missed)
+            e.trigger(missed)
+            missed = e.schedule.Next(missed)
+        }
+    }
+    // 2. wait for the next activations
+    next := e.schedule.Next(now)
+    for !next.IsZero() {
+        delay := time.Until(next)
+        if e.job.Jitter > 0 {
+            delay += time.Duration(rand.Int63n(int64(e.job.Jitter)))
+        }
+        timer := time.NewTimer(delay)
+        select {
+        case <-timer.C:
+        case <-e.ctx.Done():
+            timer.Stop()
+            return
+        }
+        e.trigger(next)
+        next = e.schedule.Next(next)
+        if now := time.Now(); !next.IsZero() && next.Before(now) {
+            // skip the activations passed while waiting
+            next = e.schedule.Next(now)
+        }
+    }
+}
+
+// trigger runs the job for the scheduled activation according to the overlap policy
+func (e *cronEntry) trigger(scheduled time.Time) {
+    e.scheduler.recordActivation(e.job.Name, scheduled)
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if e.running {
+        switch e.job.Overlap {
+        case OverlapQueue:
+            e.pending = append(e.pending, scheduled)
+        case OverlapKill:
+            fmt.Printf("cron job: %s is still running, cancel it\n", e.job.Name)
+            e.pending = []time.Time{scheduled}
+            e.cancelRun()
+        default:
+            fmt.Printf("cron job: %s is still running, skip activation at %s\n", e.job.Name, scheduled)
+        }
+        return
+    }
+    e.running = true
+    e.pending = []time.Time{scheduled}
+    e.runs.Add(1)
+    go e.execute()
+}
+
+// execute runs the pending activations one by one
+func (e *cronEntry) execute() {
+    defer e.runs.Done()
+    for {
+        e.mu.Lock()
+        if len(e.pending) == 0 || e.ctx.Err() != nil {
+            e.running = false
+            e.pending = nil
+            e.mu.Unlock()
+            return
+        }
+        scheduled := e.pending[0]
+        e.pending = e.pending[1:]
+        ctx, cancel := context.WithCancel(e.ctx)
+        e.cancelRun = cancel
+        e.mu.Unlock()
+
+        result, err := e.runner.Run(ctx, e.job.Spec)
+        cancel()
+
+        e.mu.Lock()
+        e.history = append(e.history, CronRun{Scheduled: scheduled, Result: result, Err: err})
+        if len(e.history) > e.job.HistorySize {
+            e.history = e.history[len(e.history)-e.job.HistorySize:]
+        }
+        e.mu.Unlock()
+    }
+}
@@ -0,0 +1,154 @@
+package command
+
+import (
+    "bufio"
+    "context"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+const (
+    InterpreterBash = "bash"
+    InterpreterPython = "python3"
+    InterpreterPowerShell = "pwsh"
+
+    scriptDirPrefix = "command-script-"
+    scriptFileName = "script"
+    scriptDirMode = 0700
+    scriptFileMode = 0700
+)
+
+// Script describes a script body which is written to a temp file and run by an interpreter
+type Script struct {
+    // Body is the script content
+    Body string
+    // Interpreter runs the script, empty means detect it from the shebang, or bash if there is none
+    Interpreter string
+    // Args are the script arguments
+    Args []string
+    // Extension of the script file, empty means derive it from the interpreter
+    Extension string
+    // Dir is the working directory
+    Dir string
+    // Stdout receives the script stdout
+    Stdout io.Writer
+    // Stderr receives the script stderr
+    Stderr io.Writer
+    // Timeout is the total execution time limit, zero means no limit
+    Timeout time.Duration
+    // KeepOnFailure keeps the script file when the run fails, for debugging
+    KeepOnFailure bool
+}
+
+// RunScript writes the script to a private temp dir, runs it and removes it afterwards
+func (r *Runner) RunScript(ctx context.Context, script Script) (result *Result, err error) {
+
+    // 1. resolve interpreter
+    interpreter, interpreterArgs := script.Interpreter, []string(nil)
+    if interpreter == "" {
+        interpreter, interpreterArgs = parseShebang(script.Body)
+    }
+    if interpreter == "" {
+        interpreter = InterpreterBash
+    }
+    extension := script.Extension
+    if extension == "" {
+        extension = scriptExtension(interpreter)
+    }
+
+    // 2. write script to a private temp dir, inside the chroot if there is one
+    dir, err := ioutil.TempDir(r.hostPath(os.TempDir()), scriptDirPrefix)
+    if err != nil {
+        return &Result{Status: Fail}, err
+    }
+    defer func() {
+        if script.KeepOnFailure && (err != nil || result.Status != Success || result.ExitCode != 0) {
+            fmt.Printf("keep script dir %s for debugging\n", dir)
+            return
+        }
+        _ = os.RemoveAll(dir)
+    }()
+    if err = os.Chmod(dir, scriptDirMode); err != nil {
+        return &Result{Status: Fail}, err
+    }
+    scriptPath := filepath.Join(dir, scriptFileName+extension)
+    if err = ioutil.WriteFile(scriptPath, []byte(script.Body), scriptFileMode); err != nil {
+        return &Result{Status: Fail}, err
+    }
+    if r.user != "" {
+        uid, gid, _, err := getUserCredentials(r.user)
+        if err != nil {
+            return &Result{Status: Fail}, err
+        }
+        for _, name := range []string{dir, scriptPath} {
+            if err := os.Chown(name, int(uid), int(gid)); err != nil {
+                return &Result{Status: Fail}, err
+            }
+        }
+    }
+
+    // 3. run script
+    var args []string
+    args = append(args, interpreterArgs...)
+    args = append(args, scriptArgs(interpreter, filepath.Join(os.TempDir(), filepath.Base(dir), filepath.Base(scriptPath)))...)
+    args = append(args, script.Args...)
+    return r.Run(ctx, Spec{
+        Name: interpreter,
+        Args: args,
+        Dir: script.Dir,
+        Stdout: script.Stdout,
+        Stderr: script.Stderr,
+        Timeout: script.Timeout,
+    })
+}
+
+// parseShebang returns the interpreter and its arguments from the first line of body
+func parseShebang(body string) (string, []string) {
+    line, _ := bufio.NewReader(strings.NewReader(body)).ReadString('\n')
+    if !strings.HasPrefix(line, "#!") {
+        return "", nil
+    }
+    fields := strings.Fields(line[2:])
+    if len(fields) == 0 {
+        return "", nil
+    }
+    // #!/usr/bin/env [-S] python3 -u
+    if filepath.Base(fields[0]) == "env" {
+        fields = fields[1:]
+        for len(fields) > 0 && strings.HasPrefix(fields[0], "-") {
+            fields = fields[1:]
+        }
+        if len(fields) == 0 {
+            return "", nil
+        }
+    }
+    return fields[0], fields[1:]
+}
+
+// scriptExtension returns the file extension expected by the interpreter
+func scriptExtension(interpreter string) string {
+    name := filepath.Base(interpreter)
+    switch {
+    case name == "sh" || name == "bash" || name == "zsh" || name == "dash" || name == "ksh":
+        return ".sh"
+    case strings.HasPrefix(name, "python"):
+        return ".py"
+    case name == "pwsh" || strings.HasPrefix(name, "powershell"):
+        return ".ps1"
+    }
+    return ""
+}
+
+// scriptArgs returns the interpreter arguments to run the script file
+func scriptArgs(interpreter string, scriptPath string) []string {
+    name := filepath.Base(interpreter)
+    if name == "pwsh" || strings.HasPrefix(name, "powershell") {
+        return []string{"-NoProfile", "-NonInteractive", "-File", scriptPath}
+    }
+    return []string{scriptPath}
+}
@@ -0,0 +1,79 @@
+package command
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestRunner_RunScript(t *testing.T) {
+    r := newRunner()
+    output := bytes.NewBufferString("")
+    result, err := r.RunScript(context.Background(), Script{
+        Body: "#!/usr/bin/env sh\necho \"$0 $1\"\n",
+        Args: []string{"hello"},
+        Stdout: output,
+        Stderr: output,
+        Timeout: 2 * time.Second,
+    })
+    if err != nil || result.ExitCode != 0 {
+        t.Fatal("script execute error:", err, output.String())
+    }
+    fields := strings.Fields(output.String())
+    if len(fields) != 2 || fields[1] != "hello" {
+        t.Fatal("unexpected script output:", output.String())
+    }
+    if _, err := os.Stat(fields[0]); !os.IsNotExist(err) {
+        t.Error("script file should be removed:", fields[0])
+    }
+}
+
+func TestRunner_RunScriptKeepOnFailure(t *testing.T) {
+    r := newRunner()
+    for _, exitCode := range []int{0, 3} {
+        output := bytes.NewBufferString("")
+        result, err := r.RunScript(context.Background(), Script{
+            Body: fmt.Sprintf("echo \"$0\"\nexit %d\n", exitCode),
+            Stdout: output,
+            Timeout: 2 * time.Second,
+            KeepOnFailure: true,
+        })
+        if err != nil || result.ExitCode != exitCode {
+            t.Fatal("script execute error:", err, output.String())
+        }
+        scriptPath := strings.TrimSpace(output.String())
+        _, err = os.Stat(scriptPath)
+        if exitCode == 0 && !os.IsNotExist(err) {
+            t.Error("script file should be removed after success:", scriptPath)
+        }
+        if exitCode != 0 {
+            if err != nil {
+                t.Error("script file should be kept after failure:", err)
+            }
+            _ = os.RemoveAll(filepath.Dir(scriptPath))
+        }
+    }
+}
+
+func TestParseShebang(t *testing.T) {
+    cases := map[string][]string{
+        "#!/bin/bash -e\necho": {"/bin/bash", "-e"},
+        "#!/usr/bin/env -S python3 -u\n": {"python3", "-u"},
+        "echo hello": nil,
+    }
+    for body, expected := range cases {
+        interpreter, args := parseShebang(body)
+        got := append([]string{interpreter}, args...)
+        if expected == nil {
+            expected = []string{""}
+        }
+        if strings.Join(got, " ") != strings.Join(expected, " ") {
+            t.Errorf("parseShebang(%q) = %v, expected %v", body, got, expected)
+        }
+    }
+}
@@ -0,0 +1,110 @@
+package command
+
+import (
+    "fmt"
+    "os"
+    "os/signal"
+    "sync"
+    "syscall"
+)
+
+// SignalForwardConfig selects the signals forwarded to running commands
+type SignalForwardConfig struct {
+    // Signals are the signals received by this process to forward
+    Signals []syscall.Signal
+    // Translate maps a received signal to the signal sent to the commands, others are relayed as is
+    Translate map[syscall.Signal]syscall.Signal
+}
+
+// SignalForwarder relays signals received by this process to the process groups of the running commands.
+// Once started, the selected signals no longer take their default action on this process.
+type SignalForwarder struct {
+    config SignalForwardConfig
+    mu sync.Mutex
+    executions map[*Execution]struct{}
+    signals chan os.Signal
+    stopped chan struct{}
+    wg sync.WaitGroup
+}
+
+// NewSignalForwarder creates a SignalForwarder, it forwards nothing until started
+func NewSignalForwarder(config SignalForwardConfig) *SignalForwarder {
+    return &SignalForwarder{
+        config: config,
+        executions: make(map[*Execution]struct{}),
+    }
+}
+
+// Start starts receiving and forwarding the selected signals
+func (f *SignalForwarder) Start() {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if f.signals != nil {
+        return
+    }
+    f.signals = make(chan os.Signal, len(f.config.Signals)+1)
+    f.stopped = make(chan struct{})
+    signals := make([]os.Signal, 0, len(f.config.Signals))
+    for _, sig := range f.config.Signals {
+        signals = append(signals, sig)
+    }
+    signal.Notify(f.signals, signals...)
+    f.wg.Add(1)
+    go f.loop(f.signals, f.stopped)
+}
+
+// Stop stops forwarding, the selected signals take their default action again
+func (f *SignalForwarder) Stop() {
+    f.mu.Lock()
+    if f.signals == nil {
+        f.mu.Unlock()
+        return
+    }
+    signal.Stop(f.signals)
+    close(f.stopped)
+    f.signals = nil
+    f.mu.Unlock()
+    f.wg.Wait()
+}
+
+func (f *SignalForwarder) loop(signals <-chan os.Signal, stopped <-chan struct{}) {
+    defer f.wg.Done()
+    for {
+        select {
+        case received := <-signals:
+            sig, ok := received.(syscall.Signal)
+            if !ok {
+                continue
+            }
+            if translated, ok := f.config.Translate[sig]; ok {
+                sig = translated
+            }
+            f.forward(sig)
+        case <-stopped:
+            return
+        }
+    }
+}
+
+// forward sends sig to the process groups of all registered executions
+func (f *SignalForwarder) forward(sig syscall.Signal) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    for e := range f.executions {
+        if err := signalProcessGroup(e.cmd, sig); err != nil {
+            fmt.Printf("forward signal %s to command: %s error: %v\n", sig, e.name, err)
+        }
+    }
+}
+
+func (f *SignalForwarder) register(e *Execution) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.executions[e] = struct{}{}
+}
+
+func (f *SignalForwarder) unregister(e *Execution) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    delete(f.executions, e)
+}
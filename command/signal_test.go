@@ -0,0 +1,43 @@
+package command
+
+import (
+    "bytes"
+    "context"
+    "os"
+    "syscall"
+    "testing"
+    "time"
+)
+
+func TestSignalForwarder_Translate(t *testing.T) {
+    forwarder := NewSignalForwarder(SignalForwardConfig{
+        Signals: []syscall.Signal{syscall.SIGUSR1},
+        Translate: map[syscall.Signal]syscall.Signal{syscall.SIGUSR1: syscall.SIGTERM},
+    })
+    forwarder.Start()
+    defer forwarder.Stop()
+
+    r := newRunner()
+    r.SetSignalForwarder(forwarder)
+    output := bytes.NewBufferString("")
+    e, err := r.Start(context.Background(), Spec{
+        Name: "sh",
+        Args: []string{"-c", "trap 'echo terminated; exit 0' TERM; while true; do sleep 0.1; done"},
+        Stdout: output,
+        Timeout: 5 * time.Second,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    time.Sleep(200 * time.Millisecond)
+    if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+        t.Fatal(err)
+    }
+    result, err := e.Wait()
+    if err != nil || result.Status != Success {
+        t.Fatalf("expect success, got status %d err %v", result.Status, err)
+    }
+    if output.String() != "terminated\n" {
+        t.Errorf("expect the command to receive SIGTERM, output %q", output.String())
+    }
+}
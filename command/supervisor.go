@@ -0,0 +1,286 @@
+package command
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/gaodb1210/go-common/util/unit"
+    "gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+    // RestartAlways restarts the service whenever it exits
+    RestartAlways int = iota
+    // RestartOnFailure restarts the service when it exits with an error or a non-zero exit code
+    RestartOnFailure
+    // RestartNever never restarts the service
+    RestartNever
+)
+
+const (
+    // EventStart is emitted before the service process is started
+    EventStart int = iota
+    // EventExit is emitted after the service process exits
+    EventExit
+    // EventBackoff is emitted when the service waits to be restarted
+    EventBackoff
+    // EventStop is emitted when the service is stopped and will not be restarted
+    EventStop
+    // EventFatal is emitted when the service exits too many times within the restart window
+    EventFatal
+)
+
+const (
+    defaultServiceLogMaxSize = 100 * unit.MB
+    defaultServiceLogMaxBackups = 7
+    defaultServiceMaxBackoff = 5 * time.Minute
+    defaultServiceBackoffReset = 10 * time.Minute
+)
+
+var (
+    ErrServiceExists = errors.New("service already exists")
+    ErrServiceNotFound = errors.New("service not found")
+)
+
+// ServiceConfig describes a long-running command kept alive by the Supervisor
+type ServiceConfig struct {
+    // Name identifies the service
+    Name string
+    // Spec is the service command, Spec.StopTimeout is the grace period to stop it
+    Spec Spec
+    // Restart is the restart policy, one of RestartAlways, RestartOnFailure and RestartNever
+    Restart int
+    // MaxRestarts is the max number of restarts within RestartWindow, zero means no limit
+    MaxRestarts int
+    // RestartWindow is the period MaxRestarts is counted in, zero means the whole service lifetime
+    RestartWindow time.Duration
+    // InitialBackoff is the wait before the first restart, it doubles for every restart within RestartWindow
+    InitialBackoff time.Duration
+    // MaxBackoff caps the wait before a restart, zero means 5m
+    MaxBackoff time.Duration
+    // BackoffReset is how long a run has to last to reset the wait to InitialBackoff, zero means 10m
+    BackoffReset time.Duration
+    // LogFile receives stdout and stderr of the service with rotation, empty means use Spec.Stdout and Spec.Stderr
+    LogFile string
+    // LogMaxSize is the size to rotate LogFile, zero means 100MB
+    LogMaxSize unit.Bytes
+    // LogMaxBackups is the number of rotated log files to keep, zero means 7
+    LogMaxBackups int
+    // LogMaxAge is the number of days to keep rotated log files, zero means no limit
+    LogMaxAge int
+    // LogCompress compresses rotated log files
+    LogCompress bool
+}
+
+// Event reports a lifecycle change of a supervised service
+type Event struct {
+    Service string
+    Type int
+    Time time.Time
+    // Restarts is the number of restarts within the restart window
+    Restarts int
+    // Result and Err are set for EventExit
+    Result *Result
+    Err error
+    // Backoff is set for EventBackoff
+    Backoff time.Duration
+}
+
+// Supervisor starts services, watches them exit and restarts them according to their restart policy
+type Supervisor struct {
+    runner *Runner
+    onEvent func(Event)
+    mu sync.Mutex
+    services map[string]*service
+}
+
+// NewSupervisor creates a Supervisor which runs services with the config of runner, and reports events to onEvent
+func NewSupervisor(runner *Runner, onEvent func(Event)) *Supervisor {
+    if runner == nil {
+        runner = newRunner()
+    }
+    return &Supervisor{
+        runner: runner.Clone(),
+        onEvent: onEvent,
+        services: make(map[string]*service),
+    }
+}
+
+// Add starts the service and keeps it running
+func (s *Supervisor) Add(config ServiceConfig) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.services[config.Name]; ok {
+        return ErrServiceExists
+    }
+    svc := &service{
+        supervisor: s,
+        config: config,
+        runner: s.runner.Clone(),
+        done: make(chan struct{}),
+    }
+    // restarts are decided by the restart policy
+    svc.runner.retryPolicy = RetryPolicy{}
+    if config.LogFile != "" {
+        maxSize := config.LogMaxSize
+        if maxSize <= 0 {
+            maxSize = defaultServiceLogMaxSize
+        }
+        maxBackups := config.LogMaxBackups
+        if maxBackups <= 0 {
+            maxBackups = defaultServiceLogMaxBackups
+        }
+        svc.logWriter = &lumberjack.Logger{
+            Filename: config.LogFile,
+            MaxSize: int((maxSize + unit.MB - 1) / unit.MB),
+            MaxAge: config.LogMaxAge,
+            MaxBackups: maxBackups,
+            LocalTime: true,
+            Compress: config.LogCompress,
+        }
+        svc.config.Spec.Stdout = svc.logWriter
+        svc.config.Spec.Stderr = svc.logWriter
+    }
+    svc.ctx, svc.cancel = context.WithCancel(context.Background())
+    s.services[config.Name] = svc
+    go svc.loop()
+    return nil
+}
+
+// Stop stops the service gracefully and waits for it to exit
+func (s *Supervisor) Stop(name string) error {
+    s.mu.Lock()
+    svc, ok := s.services[name]
+    delete(s.services, name)
+    s.mu.Unlock()
+    if !ok {
+        return ErrServiceNotFound
+    }
+    svc.cancel()
+    <-svc.done
+    return nil
+}
+
+// StopAll stops all services gracefully and waits for them to exit
+func (s *Supervisor) StopAll() {
+    s.mu.Lock()
+    services := s.services
+    s.services = make(map[string]*service)
+    s.mu.Unlock()
+    for _, svc := range services {
+        svc.cancel()
+    }
+    for _, svc := range services {
+        <-svc.done
+    }
+}
+
+// Services returns the names of the supervised services
+func (s *Supervisor) Services() []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    names := make([]string, 0, len(s.services))
+    for name := range s.services {
+        names = append(names, name)
+    }
+    return names
+}
+
+func (s *Supervisor) emit(event Event) {
+    event.Time = time.Now()
+    if s.onEvent != nil {
+        s.onEvent(event)
+    }
+}
+
+type service struct {
+    supervisor *Supervisor
+    config ServiceConfig
+    runner *Runner
+    logWriter *lumberjack.Logger
+    ctx context.Context
+    cancel context.CancelFunc
+    done chan struct{}
+}
+
+func (svc *service) loop() {
+    defer close(svc.done)
+    if svc.logWriter != nil {
+        defer svc.logWriter.Close()
+    }
+    s := svc.supervisor
+    name := svc.config.Name
+    var restarts []time.Time
+    backoffPolicy := RetryPolicy{
+        InitialBackoff: svc.config.InitialBackoff,
+        MaxBackoff: svc.config.MaxBackoff,
+    }
+    if backoffPolicy.MaxBackoff <= 0 {
+        backoffPolicy.MaxBackoff = defaultServiceMaxBackoff
+    }
+    backoffReset := svc.config.BackoffReset
+    if backoffReset <= 0 {
+        backoffReset = defaultServiceBackoffReset
+    }
+    // backoffAttempt is the number of restarts since the service last ran healthily
+    backoffAttempt := 0
+    for {
+        // 1. run service
+        s.emit(Event{Service: name, Type: EventStart, Restarts: len(restarts)})
+        result, err := svc.runner.Run(svc.ctx, svc.config.Spec)
+        s.emit(Event{Service: name, Type: EventExit, Restarts: len(restarts), Result: result, Err: err})
+        if svc.ctx.Err() != nil || !svc.shouldRestart(result, err) {
+            s.emit(Event{Service: name, Type: EventStop, Restarts: len(restarts)})
+            return
+        }
+        // 2. check restarts within the window
+        now := time.Now()
+        if svc.config.RestartWindow > 0 {
+            kept := restarts[:0]
+            for _, t := range restarts {
+                if now.Sub(t) < svc.config.RestartWindow {
+                    kept = append(kept, t)
+                }
+            }
+            restarts = kept
+        }
+        if svc.config.MaxRestarts > 0 && len(restarts) >= svc.config.MaxRestarts {
+            fmt.Printf("service: %s exits %d times within %s, give up\n", name, len(restarts)+1, svc.config.RestartWindow)
+            s.emit(Event{Service: name, Type: EventFatal, Restarts: len(restarts), Result: result, Err: err})
+            return
+        }
+        // 3. wait backoff, a run which lasted long enough starts over from the initial backoff
+        if result.Duration() >= backoffReset {
+            backoffAttempt = 0
+        }
+        if backoffAttempt++; backoffAttempt > len(restarts)+1 {
+            // the restarts out of the window are not counted
+            backoffAttempt = len(restarts) + 1
+        }
+        backoff := backoffPolicy.backoff(backoffAttempt)
+        restarts = append(restarts, now)
+        s.emit(Event{Service: name, Type: EventBackoff, Restarts: len(restarts), Backoff: backoff})
+        timer := time.NewTimer(backoff)
+        select {
+        case <-timer.C:
+        case <-svc.ctx.Done():
+            timer.Stop()
+            s.emit(Event{Service: name, Type: EventStop, Restarts: len(restarts)})
+            return
+        }
+    }
+}
+
+// shouldRestart reports whether the restart policy restarts the service after it exits
+func (svc *service) shouldRestart(result *Result, err error) bool {
+    switch svc.config.Restart {
+    case RestartAlways:
+        return true
+    case RestartOnFailure:
+        return err != nil || result.Status != Success || result.ExitCode != 0
+    }
+    return false
+}
@@ -0,0 +1,139 @@
+package command
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestSupervisor_RestartOnFailure(t *testing.T) {
+    var mu sync.Mutex
+    var events []int
+    fatal := make(chan struct{})
+    s := NewSupervisor(newRunner(), func(event Event) {
+        mu.Lock()
+        events = append(events, event.Type)
+        mu.Unlock()
+        if event.Type == EventFatal {
+            close(fatal)
+        }
+    })
+    err := s.Add(ServiceConfig{
+        Name: "fail",
+        Spec: Spec{Name: "sh", Args: []string{"-c", "exit 1"}},
+        Restart: RestartOnFailure,
+        MaxRestarts: 2,
+        RestartWindow: time.Minute,
+        InitialBackoff: 10 * time.Millisecond,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case <-fatal:
+    case <-time.After(5 * time.Second):
+        t.Fatal("service is not given up")
+    }
+    mu.Lock()
+    defer mu.Unlock()
+    expected := []int{EventStart, EventExit, EventBackoff, EventStart, EventExit, EventBackoff, EventStart, EventExit, EventFatal}
+    if len(events) != len(expected) {
+        t.Fatalf("expect events %v, got %v", expected, events)
+    }
+    for i := range expected {
+        if events[i] != expected[i] {
+            t.Fatalf("expect events %v, got %v", expected, events)
+        }
+    }
+}
+
+func TestSupervisor_BackoffWithoutWindow(t *testing.T) {
+    for _, c := range []struct {
+        name string
+        config ServiceConfig
+        restarts int
+        min time.Duration
+        max time.Duration
+    }{
+        // the restarts are counted for the whole lifetime, the backoff stops at the cap
+        {"crash", ServiceConfig{
+            Spec: Spec{Name: "true"},
+            InitialBackoff: time.Millisecond,
+            MaxBackoff: 16 * time.Millisecond,
+        }, 40, time.Millisecond, 16 * time.Millisecond},
+        // every run lasts long enough to reset the backoff
+        {"healthy", ServiceConfig{
+            Spec: Spec{Name: "sleep", Args: []string{"0.1"}},
+            InitialBackoff: time.Millisecond,
+            BackoffReset: 50 * time.Millisecond,
+        }, 5, time.Millisecond, time.Millisecond},
+    } {
+        backoffs := make(chan time.Duration, 100)
+        s := NewSupervisor(newRunner(), func(event Event) {
+            if event.Type == EventBackoff {
+                backoffs <- event.Backoff
+            }
+        })
+        config := c.config
+        config.Name = c.name
+        config.Restart = RestartAlways
+        if err := s.Add(config); err != nil {
+            t.Fatal(err)
+        }
+        var last time.Duration
+        for i := 0; i < c.restarts; i++ {
+            select {
+            case last = <-backoffs:
+            case <-time.After(5 * time.Second):
+                t.Fatalf("%s: service is not restarted", c.name)
+            }
+            if last < c.min || last > c.max {
+                t.Fatalf("%s: restart %d: unexpected backoff %s", c.name, i+1, last)
+            }
+        }
+        if last != c.max {
+            t.Errorf("%s: expect the backoff %s, got %s", c.name, c.max, last)
+        }
+        s.StopAll()
+    }
+}
+
+func TestSupervisor_StopGracefully(t *testing.T) {
+    dir, err := ioutil.TempDir("", "supervisor")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    logFile := filepath.Join(dir, "service.log")
+
+    s := NewSupervisor(newRunner(), nil)
+    err = s.Add(ServiceConfig{
+        Name: "trap",
+        Spec: Spec{
+            Name: "sh",
+            Args: []string{"-c", "trap 'echo terminated; exit 0' TERM; echo started; while true; do sleep 0.1; done"},
+            StopTimeout: 2 * time.Second,
+        },
+        Restart: RestartAlways,
+        LogFile: logFile,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    time.Sleep(300 * time.Millisecond)
+    start := time.Now()
+    if err := s.Stop("trap"); err != nil {
+        t.Fatal(err)
+    }
+    if time.Since(start) >= 2*time.Second {
+        t.Errorf("service is not stopped by SIGTERM")
+    }
+    content, _ := ioutil.ReadFile(logFile)
+    if !strings.Contains(string(content), "started") || !strings.Contains(string(content), "terminated") {
+        t.Errorf("unexpected service log: %q", content)
+    }
+}
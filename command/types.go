@@ -2,22 +2,80 @@ package command
 
 import (
     "errors"
+    "io"
     "os"
+    "time"
 )
 
 const (
     Success int = iota
     Fail
     Timeout
+    Canceled
+    IdleTimeout
+    OutputLimitExceeded
     groupsIdentifier = "groups="
+    outputCopyDelay = 200 * time.Millisecond
 )
 
 var (
     ErrCommandStart = errors.New("error occurred starting the command")
     ErrCommandTimeout = errors.New("command execute timeout")
+    ErrCommandIdleTimeout = errors.New("command produced no output within the idle timeout")
+    ErrOutputLimitExceeded = errors.New("command output exceeds the limit")
 )
 
 type WaitProcessResult struct {
     processState *os.ProcessState
     err error
-}
\ No newline at end of file
+}
+
+// Spec describes a command to execute
+type Spec struct {
+    // Name is the command name or path
+    Name string
+    // Args are the command arguments
+    Args []string
+    // Dir is the working directory, empty means the current directory
+    Dir string
+    // Env is the command environment, empty means the current process environment
+    Env []string
+    // Stdout receives the command stdout, nil discards it
+    Stdout io.Writer
+    // Stderr receives the command stderr, nil discards it
+    Stderr io.Writer
+    // Timeout is the total execution time limit, zero means no limit
+    Timeout time.Duration
+    // StopTimeout is the wait between SIGTERM and SIGKILL when the run is canceled, zero kills at once
+    StopTimeout time.Duration
+    // Log also writes stdout and stderr to rotated log files, nil means no log files
+    Log *LogFileConfig
+}
+
+// Result holds the outcome of a command execution
+type Result struct {
+    // Name, Args and Env echo the Spec, with registered secrets masked
+    Name string
+    Args []string
+    Env []string
+    ExitCode int
+    Status int
+    StartTime time.Time
+    EndTime time.Time
+    // PausedTime is how long the command was paused
+    PausedTime time.Duration
+    // Usage is the resource usage of the command process
+    Usage ResourceUsage
+    // OutputTail is the end of stdout and stderr, with secrets masked, see Runner.SetOutputTailSize
+    OutputTail string
+    // Attempts records every execution when the command is retried
+    Attempts []Attempt
+
+    // processState is the state of the exited command process, nil if it did not start
+    processState *os.ProcessState
+}
+
+// Duration returns how long the command ran
+func (r *Result) Duration() time.Duration {
+    return r.EndTime.Sub(r.StartTime)
+}
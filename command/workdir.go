@@ -0,0 +1,224 @@
+package command
+
+import (
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sync"
+    "syscall"
+)
+
+const (
+    workingDirMode = 0750
+    privateTmpPrefix = "command-tmp-"
+    privateTmpMode = 0700
+    parentDirMode = 0755
+)
+
+var (
+    ErrWorkingDir = errors.New("invalid working directory")
+
+    // umaskMu serializes the umask switches of startCommand
+    umaskMu sync.Mutex
+)
+
+// WorkingDirError is returned when the working directory is missing or not accessible by the target user,
+// it matches ErrWorkingDir with errors.Is, and unwraps to the cause like os.ErrNotExist or os.ErrPermission
+type WorkingDirError struct {
+    Dir string
+    User string
+    Err error
+}
+
+func (e *WorkingDirError) Error() string {
+    if e.User != "" {
+        return fmt.Sprintf("%s %s for user %s: %v", ErrWorkingDir, e.Dir, e.User, e.Err)
+    }
+    return fmt.Sprintf("%s %s: %v", ErrWorkingDir, e.Dir, e.Err)
+}
+
+func (e *WorkingDirError) Unwrap() error {
+    return e.Err
+}
+
+// Is reports whether target is ErrWorkingDir
+func (e *WorkingDirError) Is(target error) bool {
+    return target == ErrWorkingDir
+}
+
+// SetChroot set the root directory of the command, Spec.Dir is then inside the root,
+// and Spec.Name should be an absolute path inside the root
+func (r *Runner) SetChroot(chroot string) {
+    r.chroot = chroot
+}
+
+// SetUmask set the umask of the command. The umask belongs to the whole process, so it is switched
+// while the command is forked, files created by other goroutines at that moment get the umask too.
+func (r *Runner) SetUmask(umask os.FileMode) {
+    r.umask = umask & os.ModePerm
+    r.umaskSet = true
+}
+
+// SetCreateDir set whether to create the missing working directory, owned by the target user
+func (r *Runner) SetCreateDir(createDir bool) {
+    r.createDir = createDir
+}
+
+// SetPrivateTmp set whether to run the command with a private TMPDIR, which is removed after the command exits
+func (r *Runner) SetPrivateTmp(privateTmp bool) {
+    r.privateTmp = privateTmp
+}
+
+// hostPath returns the path outside the chroot of a path inside it
+func (r *Runner) hostPath(path string) string {
+    if r.chroot == "" {
+        return path
+    }
+    return filepath.Join(r.chroot, path)
+}
+
+// startCommand starts cmd with the umask of the runner
+func (r *Runner) startCommand(cmd *exec.Cmd) error {
+    if !r.umaskSet {
+        return cmd.Start()
+    }
+    umaskMu.Lock()
+    defer umaskMu.Unlock()
+    old := syscall.Umask(int(r.umask))
+    defer syscall.Umask(old)
+    return cmd.Start()
+}
+
+// prepareDir checks or creates the working directory, and creates the private temp dir.
+// It returns the private temp dir path inside the chroot, the caller removes it with removePrivateTmp.
+func (r *Runner) prepareDir(dir string) (string, error) {
+    if dir == "" && !r.privateTmp {
+        return "", nil
+    }
+    uid, gid, groups := uint32(os.Getuid()), uint32(os.Getgid()), []uint32(nil)
+    if r.user != "" {
+        var err error
+        if uid, gid, groups, err = getUserCredentials(r.user); err != nil {
+            return "", err
+        }
+    }
+    // 1. working dir
+    if dir != "" {
+        if err := r.prepareWorkingDir(r.hostPath(dir), uid, gid, groups); err != nil {
+            return "", &WorkingDirError{Dir: dir, User: r.user, Err: err}
+        }
+    }
+    // 2. private temp dir
+    if !r.privateTmp {
+        return "", nil
+    }
+    tmpRoot := r.hostPath(os.TempDir())
+    tmp, err := ioutil.TempDir(tmpRoot, privateTmpPrefix)
+    if err != nil {
+        return "", err
+    }
+    if err := os.Chmod(tmp, privateTmpMode); err != nil {
+        _ = os.RemoveAll(tmp)
+        return "", err
+    }
+    if err := os.Chown(tmp, int(uid), int(gid)); err != nil {
+        _ = os.RemoveAll(tmp)
+        return "", err
+    }
+    return filepath.Join(os.TempDir(), filepath.Base(tmp)), nil
+}
+
+// removePrivateTmp removes the private temp dir created by prepareDir
+func (r *Runner) removePrivateTmp(tmp string) {
+    if tmp == "" {
+        return
+    }
+    if err := os.RemoveAll(r.hostPath(tmp)); err != nil {
+        fmt.Printf("remove private tmp %s error: %v\n", tmp, err)
+    }
+}
+
+// prepareWorkingDir creates the missing dir if enabled, and checks that the user can enter every directory of the path
+func (r *Runner) prepareWorkingDir(dir string, uid uint32, gid uint32, groups []uint32) error {
+    dir, err := filepath.Abs(dir)
+    if err != nil {
+        return err
+    }
+    info, err := os.Stat(dir)
+    if os.IsNotExist(err) && r.createDir {
+        if err := mkdirAllOwned(dir, uid, gid); err != nil {
+            return err
+        }
+        info, err = os.Stat(dir)
+    }
+    if err != nil {
+        return unwrapPathError(err)
+    }
+    if !info.IsDir() {
+        return syscall.ENOTDIR
+    }
+    if uid == 0 {
+        return nil
+    }
+    for path := dir; ; path = filepath.Dir(path) {
+        info, err := os.Stat(path)
+        if err != nil {
+            return unwrapPathError(err)
+        }
+        if !canSearch(info, uid, gid, groups) {
+            return os.ErrPermission
+        }
+        if path == filepath.Dir(path) {
+            return nil
+        }
+    }
+}
+
+// mkdirAllOwned creates dir owned by uid and gid, the missing parents are created
+// owned by the current user and searchable by everyone
+func mkdirAllOwned(dir string, uid uint32, gid uint32) error {
+    if err := os.MkdirAll(filepath.Dir(dir), parentDirMode); err != nil {
+        return unwrapPathError(err)
+    }
+    if err := os.Mkdir(dir, workingDirMode); err != nil {
+        if os.IsExist(err) {
+            return nil
+        }
+        return unwrapPathError(err)
+    }
+    if err := os.Chown(dir, int(uid), int(gid)); err != nil {
+        return unwrapPathError(err)
+    }
+    return nil
+}
+
+// canSearch reports whether the user has the execute permission on a directory
+func canSearch(info os.FileInfo, uid uint32, gid uint32, groups []uint32) bool {
+    stat, ok := info.Sys().(*syscall.Stat_t)
+    if !ok {
+        return true
+    }
+    mode := info.Mode().Perm()
+    if stat.Uid == uid {
+        return mode&0100 != 0
+    }
+    inGroup := stat.Gid == gid
+    for _, g := range groups {
+        inGroup = inGroup || stat.Gid == g
+    }
+    if inGroup {
+        return mode&0010 != 0
+    }
+    return mode&0001 != 0
+}
+
+func unwrapPathError(err error) error {
+    var pathErr *os.PathError
+    if errors.As(err, &pathErr) {
+        return pathErr.Err
+    }
+    return err
+}
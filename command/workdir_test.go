@@ -0,0 +1,169 @@
+package command
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "testing"
+    "time"
+)
+
+func TestRunner_WorkingDir(t *testing.T) {
+    dir, err := ioutil.TempDir("", "workdir")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    missing := filepath.Join(dir, "a", "b")
+
+    r := newRunner()
+    result, err := r.Run(context.Background(), Spec{Name: "pwd", Dir: missing, Timeout: time.Second})
+    if !errors.Is(err, ErrWorkingDir) || !errors.Is(err, os.ErrNotExist) || result.Status != Fail {
+        t.Fatalf("expect missing working dir error, got %v", err)
+    }
+
+    r.SetCreateDir(true)
+    r.SetUmask(0027)
+    var stdout bytes.Buffer
+    _, err = r.Run(context.Background(), Spec{Name: "sh", Args: []string{"-c", "pwd; umask"}, Dir: missing, Stdout: &stdout, Timeout: time.Second})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stdout.String() != missing+"\n0027\n" {
+        t.Errorf("unexpected output %q", stdout.String())
+    }
+}
+
+func TestRunner_PrivateTmp(t *testing.T) {
+    r := newRunner()
+    r.SetPrivateTmp(true)
+    var stdout bytes.Buffer
+    _, err := r.Run(context.Background(), Spec{Name: "sh", Args: []string{"-c", "touch $TMPDIR/file && echo $TMPDIR"}, Stdout: &stdout, Timeout: time.Second})
+    if err != nil {
+        t.Fatal(err)
+    }
+    tmp := strings.TrimSpace(stdout.String())
+    if !strings.HasPrefix(filepath.Base(tmp), privateTmpPrefix) {
+        t.Fatalf("unexpected TMPDIR %q", tmp)
+    }
+    if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+        t.Errorf("expect %s removed, got %v", tmp, err)
+    }
+}
+
+func TestRunner_WorkingDirPermission(t *testing.T) {
+    if os.Getuid() != 0 {
+        t.Skip("need root to run as another user")
+    }
+    dir, err := ioutil.TempDir("", "workdir")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    r := newRunner()
+    r.SetUser("nobody")
+    _, err = r.Run(context.Background(), Spec{Name: "pwd", Dir: dir, Timeout: time.Second})
+    if !errors.Is(err, ErrWorkingDir) || !errors.Is(err, os.ErrPermission) {
+        t.Errorf("expect permission error, got %v", err)
+    }
+}
+
+func TestRunner_CreateDirOwner(t *testing.T) {
+    if os.Getuid() != 0 {
+        t.Skip("need root to run as another user")
+    }
+    dir, err := ioutil.TempDir("", "workdir")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    if err := os.Chmod(dir, 0755); err != nil {
+        t.Fatal(err)
+    }
+    parent := filepath.Join(dir, "a")
+    missing := filepath.Join(parent, "b")
+
+    r := newRunner()
+    r.SetUser("nobody")
+    r.SetCreateDir(true)
+    _, err = r.Run(context.Background(), Spec{Name: "pwd", Dir: missing, Timeout: time.Second})
+    if err != nil {
+        t.Fatal(err)
+    }
+    // only the working dir belongs to the user
+    uid, _, _, err := getUserCredentials("nobody")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for path, owner := range map[string]uint32{parent: 0, missing: uid} {
+        info, err := os.Stat(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if stat := info.Sys().(*syscall.Stat_t); stat.Uid != owner {
+            t.Errorf("expect %s owned by %d, got %d", path, owner, stat.Uid)
+        }
+    }
+}
+
+func TestRunner_Chroot(t *testing.T) {
+    if os.Getuid() != 0 {
+        t.Skip("need root to chroot")
+    }
+    root, err := ioutil.TempDir("", "chroot")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(root)
+    // a minimal root with sh and the libraries it links
+    output, err := exec.Command("ldd", "/bin/sh").Output()
+    if err != nil {
+        t.Skip("ldd is not available")
+    }
+    files := []string{"/bin/sh"}
+    for _, field := range strings.Fields(string(output)) {
+        if strings.HasPrefix(field, "/") {
+            files = append(files, field)
+        }
+    }
+    for _, file := range files {
+        content, err := ioutil.ReadFile(file)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := os.MkdirAll(filepath.Join(root, filepath.Dir(file)), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := ioutil.WriteFile(filepath.Join(root, file), content, 0755); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := os.MkdirAll(filepath.Join(root, os.TempDir()), 01777); err != nil {
+        t.Fatal(err)
+    }
+
+    r := newRunner()
+    r.SetChroot(root)
+    r.SetUmask(0027)
+    var stdout bytes.Buffer
+    _, err = r.RunScript(context.Background(), Script{
+        Body: "umask; echo $0",
+        Interpreter: "/bin/sh",
+        Stdout: &stdout,
+        Timeout: 3 * time.Second,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+    if len(lines) != 2 || lines[0] != "0027" || !strings.HasPrefix(lines[1], filepath.Join(os.TempDir(), scriptDirPrefix)) {
+        t.Errorf("unexpected output %q", stdout.String())
+    }
+}
@@ -0,0 +1,335 @@
+package process
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gaodb1210/go-common/util/unit"
+)
+
+const (
+    // clockTicks is USER_HZ, the unit of the cpu times in /proc/<pid>/stat, which is 100 on linux
+    clockTicks = 100
+)
+
+// procRoot is the mount point of procfs
+var procRoot = "/proc"
+
+// Stat is parsed from /proc/<pid>/stat
+type Stat struct {
+    PID int
+    // Comm is the executable name, truncated to 15 characters by the kernel
+    Comm string
+    // State is one of R, S, D, Z, T, t, X, I
+    State string
+    PPID int
+    PGRP int
+    Session int
+    NumThreads int
+    // UserTime and SystemTime are the cpu times of the process
+    UserTime time.Duration
+    SystemTime time.Duration
+    // StartTime is the start of the process since boot
+    StartTime time.Duration
+    VSize unit.Bytes
+    RSS unit.Bytes
+}
+
+// Status is parsed from /proc/<pid>/status
+type Status struct {
+    Name string
+    State string
+    PID int
+    PPID int
+    // UIDs and GIDs are the real, effective, saved set and filesystem ids
+    UIDs [4]int
+    GIDs [4]int
+    Groups []int
+    Threads int
+    VmPeak unit.Bytes
+    VmSize unit.Bytes
+    VmHWM unit.Bytes
+    VmRSS unit.Bytes
+    VmSwap unit.Bytes
+    VoluntaryCtxtSwitches uint64
+    NonvoluntaryCtxtSwitches uint64
+}
+
+// IO is parsed from /proc/<pid>/io, reading it needs the same permission as ptrace
+type IO struct {
+    RChar uint64
+    WChar uint64
+    SyscR uint64
+    SyscW uint64
+    ReadBytes uint64
+    WriteBytes uint64
+    CancelledWriteBytes uint64
+}
+
+// Cgroup is one line of /proc/<pid>/cgroup
+type Cgroup struct {
+    HierarchyID int
+    // Controllers is empty for the cgroup v2 unified hierarchy
+    Controllers []string
+    Path string
+}
+
+func procPath(pid int, name string) string {
+    return filepath.Join(procRoot, strconv.Itoa(pid), name)
+}
+
+// ReadStat reads /proc/<pid>/stat
+func ReadStat(pid int) (*Stat, error) {
+    content, err := ioutil.ReadFile(procPath(pid, "stat"))
+    if err != nil {
+        return nil, err
+    }
+    return parseStat(content)
+}
+
+func parseStat(content []byte) (*Stat, error) {
+    // the comm may contain spaces and parentheses, it ends at the last ')'
+    start := bytes.IndexByte(content, '(')
+    end := bytes.LastIndexByte(content, ')')
+    if start < 0 || end < start {
+        return nil, fmt.Errorf("invalid stat %q", content)
+    }
+    pid, err := strconv.Atoi(strings.TrimSpace(string(content[:start])))
+    if err != nil {
+        return nil, fmt.Errorf("invalid stat pid: %v", err)
+    }
+    // fields after comm, starting from field 3 (state)
+    fields := strings.Fields(string(content[end+1:]))
+    if len(fields) < 22 {
+        return nil, fmt.Errorf("invalid stat %q", content)
+    }
+    var values [22]int64
+    for i := 1; i < 22; i++ {
+        if values[i], err = strconv.ParseInt(fields[i], 10, 64); err != nil {
+            return nil, fmt.Errorf("invalid stat field %d: %v", i+3, err)
+        }
+    }
+    // field n is fields[n-3]
+    return &Stat{
+        PID: pid,
+        Comm: string(content[start+1 : end]),
+        State: fields[0],
+        PPID: int(values[4-3]),
+        PGRP: int(values[5-3]),
+        Session: int(values[6-3]),
+        UserTime: ticksToDuration(values[14-3]),
+        SystemTime: ticksToDuration(values[15-3]),
+        NumThreads: int(values[20-3]),
+        StartTime: ticksToDuration(values[22-3]),
+        VSize: unit.Bytes(values[23-3]),
+        RSS: unit.Bytes(values[24-3] * int64(os.Getpagesize())),
+    }, nil
+}
+
+// ReadStatus reads /proc/<pid>/status
+func ReadStatus(pid int) (*Status, error) {
+    values, err := readKeyValues(procPath(pid, "status"), ":")
+    if err != nil {
+        return nil, err
+    }
+    status := &Status{
+        Name: values["Name"],
+        State: strings.Fields(values["State"] + " ")[0],
+        PID: atoi(values["Pid"]),
+        PPID: atoi(values["PPid"]),
+        Threads: atoi(values["Threads"]),
+        VmPeak: parseKB(values["VmPeak"]),
+        VmSize: parseKB(values["VmSize"]),
+        VmHWM: parseKB(values["VmHWM"]),
+        VmRSS: parseKB(values["VmRSS"]),
+        VmSwap: parseKB(values["VmSwap"]),
+        VoluntaryCtxtSwitches: parseUint(values["voluntary_ctxt_switches"]),
+        NonvoluntaryCtxtSwitches: parseUint(values["nonvoluntary_ctxt_switches"]),
+    }
+    for i, field := range strings.Fields(values["Uid"]) {
+        if i < len(status.UIDs) {
+            status.UIDs[i] = atoi(field)
+        }
+    }
+    for i, field := range strings.Fields(values["Gid"]) {
+        if i < len(status.GIDs) {
+            status.GIDs[i] = atoi(field)
+        }
+    }
+    for _, field := range strings.Fields(values["Groups"]) {
+        status.Groups = append(status.Groups, atoi(field))
+    }
+    return status, nil
+}
+
+// ReadCmdline reads the arguments from /proc/<pid>/cmdline, it is empty for kernel threads and zombies
+func ReadCmdline(pid int) ([]string, error) {
+    return readNulSeparated(procPath(pid, "cmdline"))
+}
+
+// ReadEnviron reads the initial environment from /proc/<pid>/environ
+func ReadEnviron(pid int) ([]string, error) {
+    return readNulSeparated(procPath(pid, "environ"))
+}
+
+// ReadExe returns the path of the executable from /proc/<pid>/exe
+func ReadExe(pid int) (string, error) {
+    return os.Readlink(procPath(pid, "exe"))
+}
+
+// ReadIO reads /proc/<pid>/io
+func ReadIO(pid int) (*IO, error) {
+    values, err := readKeyValues(procPath(pid, "io"), ":")
+    if err != nil {
+        return nil, err
+    }
+    return &IO{
+        RChar: parseUint(values["rchar"]),
+        WChar: parseUint(values["wchar"]),
+        SyscR: parseUint(values["syscr"]),
+        SyscW: parseUint(values["syscw"]),
+        ReadBytes: parseUint(values["read_bytes"]),
+        WriteBytes: parseUint(values["write_bytes"]),
+        CancelledWriteBytes: parseUint(values["cancelled_write_bytes"]),
+    }, nil
+}
+
+// CountFDs returns the number of open file descriptors in /proc/<pid>/fd
+func CountFDs(pid int) (int, error) {
+    f, err := os.Open(procPath(pid, "fd"))
+    if err != nil {
+        return 0, err
+    }
+    defer f.Close()
+    names, err := f.Readdirnames(-1)
+    if err != nil {
+        return 0, err
+    }
+    return len(names), nil
+}
+
+// ReadCgroups reads /proc/<pid>/cgroup
+func ReadCgroups(pid int) ([]Cgroup, error) {
+    content, err := ioutil.ReadFile(procPath(pid, "cgroup"))
+    if err != nil {
+        return nil, err
+    }
+    var cgroups []Cgroup
+    for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+        parts := strings.SplitN(line, ":", 3)
+        if len(parts) != 3 {
+            continue
+        }
+        id, err := strconv.Atoi(parts[0])
+        if err != nil {
+            return nil, fmt.Errorf("invalid cgroup line %q", line)
+        }
+        cgroup := Cgroup{HierarchyID: id, Path: parts[2]}
+        if parts[1] != "" {
+            cgroup.Controllers = strings.Split(parts[1], ",")
+        }
+        cgroups = append(cgroups, cgroup)
+    }
+    return cgroups, nil
+}
+
+// BootTime returns the system boot time from /proc/stat
+func BootTime() (time.Time, error) {
+    values, err := readKeyValues(filepath.Join(procRoot, "stat"), " ")
+    if err != nil {
+        return time.Time{}, err
+    }
+    btime, err := strconv.ParseInt(values["btime"], 10, 64)
+    if err != nil {
+        return time.Time{}, fmt.Errorf("invalid btime: %v", err)
+    }
+    return time.Unix(btime, 0), nil
+}
+
+// StartedAt returns the wall clock start time of the process
+func (s *Stat) StartedAt() (time.Time, error) {
+    boot, err := BootTime()
+    if err != nil {
+        return time.Time{}, err
+    }
+    return boot.Add(s.StartTime), nil
+}
+
+// ListPIDs returns the ids of all processes
+func ListPIDs() ([]int, error) {
+    f, err := os.Open(procRoot)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    names, err := f.Readdirnames(-1)
+    if err != nil {
+        return nil, err
+    }
+    pids := make([]int, 0, len(names))
+    for _, name := range names {
+        if pid, err := strconv.Atoi(name); err == nil {
+            pids = append(pids, pid)
+        }
+    }
+    return pids, nil
+}
+
+func readKeyValues(path string, separator string) (map[string]string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    values := make(map[string]string)
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if i := strings.Index(line, separator); i > 0 {
+            values[line[:i]] = strings.TrimSpace(line[i+len(separator):])
+        }
+    }
+    return values, scanner.Err()
+}
+
+func readNulSeparated(path string) ([]string, error) {
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    content = bytes.TrimRight(content, "\x00")
+    if len(content) == 0 {
+        return nil, nil
+    }
+    return strings.Split(string(content), "\x00"), nil
+}
+
+func ticksToDuration(ticks int64) time.Duration {
+    return time.Duration(ticks) * time.Second / clockTicks
+}
+
+// parseKB parses a value like "1234 kB"
+func parseKB(value string) unit.Bytes {
+    fields := strings.Fields(value)
+    if len(fields) == 0 {
+        return 0
+    }
+    return unit.Bytes(parseUint(fields[0])) * unit.KB
+}
+
+func parseUint(value string) uint64 {
+    n, _ := strconv.ParseUint(value, 10, 64)
+    return n
+}
+
+func atoi(value string) int {
+    n, _ := strconv.Atoi(value)
+    return n
+}
@@ -0,0 +1,103 @@
+package process
+
+import (
+    "context"
+    "os"
+    "os/exec"
+    "reflect"
+    "regexp"
+    "syscall"
+    "testing"
+    "time"
+)
+
+func TestParseStat(t *testing.T) {
+    stat, err := parseStat([]byte("1234 (a (b) c) S 1 1234 1234 0 -1 4194560 100 0 0 0 250 50 0 0 20 0 3 0 12345 1048576 256 18446744073709551615"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stat.PID != 1234 || stat.Comm != "a (b) c" || stat.State != "S" || stat.PPID != 1 || stat.NumThreads != 3 {
+        t.Errorf("unexpected stat: %+v", stat)
+    }
+    if stat.UserTime != 2500*time.Millisecond || stat.SystemTime != 500*time.Millisecond || stat.StartTime != 123450*time.Millisecond {
+        t.Errorf("unexpected times: %+v", stat)
+    }
+    if stat.VSize != 1048576 || stat.RSS.ToNumber() != int64(256*os.Getpagesize()) {
+        t.Errorf("unexpected memory: %+v", stat)
+    }
+}
+
+func TestReadSelf(t *testing.T) {
+    pid := os.Getpid()
+    stat, err := ReadStat(pid)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stat.PID != pid || stat.PPID != os.Getppid() || stat.RSS <= 0 {
+        t.Errorf("unexpected stat: %+v", stat)
+    }
+    if started, err := stat.StartedAt(); err != nil || time.Since(started) < 0 || time.Since(started) > time.Hour {
+        t.Errorf("unexpected start time %s: %v", started, err)
+    }
+    status, err := ReadStatus(pid)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if status.PID != pid || status.UIDs[0] != os.Getuid() || status.VmRSS <= 0 || status.Threads < 1 {
+        t.Errorf("unexpected status: %+v", status)
+    }
+    args, err := ReadCmdline(pid)
+    if err != nil || !reflect.DeepEqual(args, os.Args) {
+        t.Errorf("unexpected cmdline %q: %v", args, err)
+    }
+    if env, err := ReadEnviron(pid); err != nil || len(env) == 0 {
+        t.Errorf("unexpected environ %q: %v", env, err)
+    }
+    if fds, err := CountFDs(pid); err != nil || fds < 3 {
+        t.Errorf("unexpected fd count %d: %v", fds, err)
+    }
+    if _, err := ReadIO(pid); err != nil {
+        t.Error(err)
+    }
+    if cgroups, err := ReadCgroups(pid); err != nil || len(cgroups) == 0 {
+        t.Errorf("unexpected cgroups %+v: %v", cgroups, err)
+    }
+    if _, err := ReadStat(-1); !os.IsNotExist(err) {
+        t.Errorf("expect not exist error, got %v", err)
+    }
+}
+
+func TestTreeAndFind(t *testing.T) {
+    cmd := exec.Command("sh", "-c", "sleep 7.25 & sleep 7.5; wait")
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    if err := cmd.Start(); err != nil {
+        t.Fatal(err)
+    }
+    defer func() {
+        _ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+        _ = cmd.Wait()
+    }()
+    time.Sleep(200 * time.Millisecond)
+
+    pids, err := FindByCmdline(regexp.MustCompile(`^sleep 7\.(25|5)$`))
+    if err != nil || len(pids) != 2 {
+        t.Fatalf("expect 2 sleep processes, got %v: %v", pids, err)
+    }
+    tree, err := BuildTree()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if descendants := tree.Descendants(cmd.Process.Pid); !reflect.DeepEqual(descendants, pids) {
+        t.Errorf("expect descendants %v, got %v", pids, descendants)
+    }
+    if node := tree.Nodes[cmd.Process.Pid]; node == nil || node.Parent == nil || node.Parent.Stat.PID != os.Getpid() {
+        t.Errorf("unexpected node %+v", node)
+    }
+    named, err := FindByName("sleep")
+    if err != nil || len(named) < 2 {
+        t.Errorf("expect sleep processes, got %v: %v", named, err)
+    }
+    if cpu, err := SampleCPU(context.Background(), pids[0], 100*time.Millisecond); err != nil || cpu > 50 {
+        t.Errorf("unexpected cpu %f: %v", cpu, err)
+    }
+}
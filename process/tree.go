@@ -0,0 +1,126 @@
+package process
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Node is a process in a Tree
+type Node struct {
+    Stat *Stat
+    Parent *Node
+    Children []*Node
+}
+
+// Tree is a snapshot of the process hierarchy
+type Tree struct {
+    Nodes map[int]*Node
+}
+
+// BuildTree reads the stat of all processes and links them by parent id
+func BuildTree() (*Tree, error) {
+    pids, err := ListPIDs()
+    if err != nil {
+        return nil, err
+    }
+    tree := &Tree{Nodes: make(map[int]*Node, len(pids))}
+    for _, pid := range pids {
+        stat, err := ReadStat(pid)
+        if err != nil {
+            // the process exited meanwhile
+            continue
+        }
+        tree.Nodes[pid] = &Node{Stat: stat}
+    }
+    for _, node := range tree.Nodes {
+        if parent, ok := tree.Nodes[node.Stat.PPID]; ok && node.Stat.PPID != node.Stat.PID {
+            node.Parent = parent
+            parent.Children = append(parent.Children, node)
+        }
+    }
+    for _, node := range tree.Nodes {
+        sort.Slice(node.Children, func(i, j int) bool {
+            return node.Children[i].Stat.PID < node.Children[j].Stat.PID
+        })
+    }
+    return tree, nil
+}
+
+// Descendants returns the ids of all descendants of pid, parents before their children
+func (t *Tree) Descendants(pid int) []int {
+    node, ok := t.Nodes[pid]
+    if !ok {
+        return nil
+    }
+    var pids []int
+    queue := append([]*Node(nil), node.Children...)
+    for len(queue) > 0 {
+        node, queue = queue[0], queue[1:]
+        pids = append(pids, node.Stat.PID)
+        queue = append(queue, node.Children...)
+    }
+    return pids
+}
+
+// SampleCPU returns the cpu usage of a process over interval, 100 means one fully used cpu
+func SampleCPU(ctx context.Context, pid int, interval time.Duration) (float64, error) {
+    before, err := ReadStat(pid)
+    if err != nil {
+        return 0, err
+    }
+    start := time.Now()
+    timer := time.NewTimer(interval)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+    case <-ctx.Done():
+        return 0, ctx.Err()
+    }
+    after, err := ReadStat(pid)
+    if err != nil {
+        return 0, err
+    }
+    elapsed := time.Since(start)
+    used := after.UserTime + after.SystemTime - before.UserTime - before.SystemTime
+    return float64(used) / float64(elapsed) * 100, nil
+}
+
+// FindByName returns the ids of the processes other than the current one whose executable name or base name of argv[0] is name
+func FindByName(name string) ([]int, error) {
+    return find(func(pid int) bool {
+        if stat, err := ReadStat(pid); err == nil && stat.Comm == name {
+            return true
+        }
+        args, err := ReadCmdline(pid)
+        return err == nil && len(args) > 0 && filepath.Base(args[0]) == name
+    })
+}
+
+// FindByCmdline returns the ids of the processes other than the current one whose arguments joined by spaces match pattern
+func FindByCmdline(pattern *regexp.Regexp) ([]int, error) {
+    return find(func(pid int) bool {
+        args, err := ReadCmdline(pid)
+        return err == nil && len(args) > 0 && pattern.MatchString(strings.Join(args, " "))
+    })
+}
+
+func find(match func(pid int) bool) ([]int, error) {
+    pids, err := ListPIDs()
+    if err != nil {
+        return nil, err
+    }
+    self := os.Getpid()
+    var found []int
+    for _, pid := range pids {
+        if pid != self && match(pid) {
+            found = append(found, pid)
+        }
+    }
+    sort.Ints(found)
+    return found, nil
+}
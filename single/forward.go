@@ -0,0 +1,209 @@
+package single
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "sync"
+    "time"
+)
+
+const (
+    defaultForwardTimeout = 10 * time.Second
+    forwardSocketMode = 0600
+    minAcceptRetryInterval = 5 * time.Millisecond
+    maxAcceptRetryInterval = time.Second
+)
+
+// Message is what a second instance forwards to the running primary instance
+type Message struct {
+    PID int `json:"pid"`
+    Args []string `json:"args"`
+    Dir string `json:"dir"`
+    Env map[string]string `json:"env,omitempty"`
+}
+
+// ForwardHandler handles a message of a second instance in the primary instance,
+// the returned code is the exit code of the second instance, zero acknowledges the message
+type ForwardHandler func(msg *Message) int
+
+type forwardReply struct {
+    ExitCode int `json:"exit_code"`
+}
+
+// SetForwardHandler set the handler of the messages forwarded by second instances.
+// With a handler CheckLock listens on a unix socket next to the lock file once it obtains the lock,
+// the messages are handled one by one.
+func (s *Single) SetForwardHandler(handler ForwardHandler) {
+    s.handler = handler
+}
+
+// SetForwardEnv set the names of the environment variables forwarded to the primary instance
+func (s *Single) SetForwardEnv(names ...string) {
+    s.forwardEnv = names
+}
+
+// SetForwardTimeout set how long Forward waits for the primary instance to reply, zero means 10s
+func (s *Single) SetForwardTimeout(timeout time.Duration) {
+    s.forwardTimeout = timeout
+}
+
+// LockOrForward tries to obtain the lock like Lock, when another instance is running,
+// it forwards the arguments to the running instance and exits the program with the replied exit code
+func (s *Single) LockOrForward() {
+    err := s.CheckLock()
+    if err == nil {
+        return
+    }
+    if !errors.Is(err, ErrAlreadyRunning) {
+        log.Fatal(err)
+    }
+    code, err := s.Forward()
+    if err != nil {
+        log.Fatal(err)
+    }
+    os.Exit(code)
+}
+
+// Forward sends the arguments, the working directory and the forwarded environment variables
+// to the running instance, and returns the exit code replied by its handler
+func (s *Single) Forward() (int, error) {
+    msg := &Message{
+        PID: os.Getpid(),
+        Args: os.Args,
+        Env: make(map[string]string),
+    }
+    var err error
+    if msg.Dir, err = os.Getwd(); err != nil {
+        return 0, err
+    }
+    for _, name := range s.forwardEnv {
+        if value, ok := os.LookupEnv(name); ok {
+            msg.Env[name] = value
+        }
+    }
+    return s.send(msg)
+}
+
+// send delivers msg to the primary instance, it retries while the primary instance is starting to listen
+func (s *Single) send(msg *Message) (int, error) {
+    timeout := s.forwardTimeout
+    if timeout <= 0 {
+        timeout = defaultForwardTimeout
+    }
+    deadline := time.Now().Add(timeout)
+    interval := minLockRetryInterval
+    for {
+        conn, err := net.DialTimeout("unix", s.socketName(), time.Until(deadline))
+        if err != nil {
+            if time.Now().Add(interval).After(deadline) {
+                return 0, fmt.Errorf("failed to connect to the running instance: %v", err)
+            }
+            time.Sleep(interval)
+            if interval *= 2; interval > maxLockRetryInterval {
+                interval = maxLockRetryInterval
+            }
+            continue
+        }
+        defer conn.Close()
+        _ = conn.SetDeadline(deadline)
+        if err := json.NewEncoder(conn).Encode(msg); err != nil {
+            return 0, fmt.Errorf("failed to forward to the running instance: %v", err)
+        }
+        var reply forwardReply
+        if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+            return 0, fmt.Errorf("failed to read the reply of the running instance: %v", err)
+        }
+        return reply.ExitCode, nil
+    }
+}
+
+// listen accepts the messages of second instances on the socket
+func (s *Single) listen() error {
+    // the socket file left by a crashed instance
+    if err := os.Remove(s.socketName()); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    listener, err := net.Listen("unix", s.socketName())
+    if err != nil {
+        return err
+    }
+    if err := os.Chmod(s.socketName(), forwardSocketMode); err != nil {
+        _ = listener.Close()
+        return err
+    }
+    s.listener = newForwardServer(listener, s.handler)
+    go s.listener.serve()
+    return nil
+}
+
+// forwardServer reads the messages of second instances concurrently, so a connection which sends nothing
+// does not block the others, and it calls the handler with one message at a time
+type forwardServer struct {
+    listener net.Listener
+    handler ForwardHandler
+    mu sync.Mutex
+    done chan struct{}
+}
+
+func newForwardServer(listener net.Listener, handler ForwardHandler) *forwardServer {
+    return &forwardServer{
+        listener: listener,
+        handler: handler,
+        done: make(chan struct{}),
+    }
+}
+
+func (f *forwardServer) serve() {
+    var delay time.Duration
+    for {
+        conn, err := f.listener.Accept()
+        if err != nil {
+            // back off on accept errors such as too many open files until the listener is closed
+            if delay == 0 {
+                delay = minAcceptRetryInterval
+            } else if delay *= 2; delay > maxAcceptRetryInterval {
+                delay = maxAcceptRetryInterval
+            }
+            select {
+            case <-f.done:
+                return
+            case <-time.After(delay):
+            }
+            continue
+        }
+        delay = 0
+        go f.handle(conn)
+    }
+}
+
+func (f *forwardServer) handle(conn net.Conn) {
+    defer conn.Close()
+    _ = conn.SetReadDeadline(time.Now().Add(defaultForwardTimeout))
+    msg := &Message{}
+    if err := json.NewDecoder(conn).Decode(msg); err != nil {
+        log.Printf("read the forwarded message: %v", err)
+        return
+    }
+    f.mu.Lock()
+    reply := forwardReply{ExitCode: f.handler(msg)}
+    f.mu.Unlock()
+    _ = conn.SetWriteDeadline(time.Now().Add(defaultForwardTimeout))
+    if err := json.NewEncoder(conn).Encode(reply); err != nil {
+        log.Printf("reply to the forwarded message of pid %d: %v", msg.PID, err)
+    }
+}
+
+// Close stops accepting the messages, the messages being read or handled are still replied
+func (f *forwardServer) Close() error {
+    close(f.done)
+    return f.listener.Close()
+}
+
+// socketName returns the socket of the primary instance next to the lock file
+func (s *Single) socketName() string {
+    return s.fileName() + ".sock"
+}
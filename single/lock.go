@@ -0,0 +1,151 @@
+package single
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "syscall"
+
+    "github.com/gaodb1210/go-common/process"
+)
+
+const (
+    // LockOFD uses open file description locks (F_OFD_SETLK), the default on linux.
+    // The lock belongs to the open file, it is neither released by closing another descriptor
+    // of the same file nor shared between goroutines of the same process.
+    LockOFD int = iota
+    // LockFlock uses flock(2) locks, which also belong to the open file
+    LockFlock
+    // LockFcntl uses classic POSIX fcntl (F_SETLK) locks, which belong to the process,
+    // closing any descriptor of the lock file in the process releases the lock
+    LockFcntl
+)
+
+// the fcntl commands of open file description locks on linux
+const (
+    fOFDGetlk = 36
+    fOFDSetlk = 37
+)
+
+// SetLockBackend set the lock backend used by CheckLock, one of LockOFD, LockFlock and LockFcntl
+func (s *Single) SetLockBackend(backend int) {
+    s.backend = backend
+}
+
+// tryLock obtains an exclusive lock on f without blocking
+func (s *Single) tryLock(f *os.File) error {
+    switch s.backend {
+    case LockFlock:
+        return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+    case LockFcntl:
+        // set the lock type to F_WRLCK, therefore the file has to be opened writable
+        flock := syscall.Flock_t{
+            Type: syscall.F_WRLCK,
+            Pid:  int32(os.Getpid()),
+        }
+        return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &flock)
+    default:
+        // the pid has to be zero for open file description locks
+        flock := syscall.Flock_t{
+            Type: syscall.F_WRLCK,
+        }
+        err := syscall.FcntlFlock(f.Fd(), fOFDSetlk, &flock)
+        if err == syscall.EINVAL {
+            // the kernel is older than 3.15
+            log.Printf("open file description locks are not supported, fall back to fcntl locks")
+            s.backend = LockFcntl
+            return s.tryLock(f)
+        }
+        return err
+    }
+}
+
+// unlock releases the lock on f
+func (s *Single) unlock(f *os.File) error {
+    switch s.backend {
+    case LockFlock:
+        return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+    case LockFcntl:
+        flock := syscall.Flock_t{
+            Type: syscall.F_UNLCK,
+            Pid:  int32(os.Getpid()),
+        }
+        return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &flock)
+    default:
+        flock := syscall.Flock_t{
+            Type: syscall.F_UNLCK,
+        }
+        return syscall.FcntlFlock(f.Fd(), fOFDSetlk, &flock)
+    }
+}
+
+// lockHolder returns the pid of the process holding a conflicting lock on f, zero if unknown
+func (s *Single) lockHolder(f *os.File) int {
+    if s.backend == LockFcntl {
+        flock := syscall.Flock_t{
+            Type: syscall.F_WRLCK,
+        }
+        if err := syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &flock); err != nil || flock.Type == syscall.F_UNLCK {
+            return 0
+        }
+        return int(flock.Pid)
+    }
+    // the kernel reports -1 as the owner of open file description locks and knows no owner of flock locks,
+    // find the process whose open file holds the lock instead
+    info, err := f.Stat()
+    if err != nil {
+        return 0
+    }
+    stat, ok := info.Sys().(*syscall.Stat_t)
+    if !ok {
+        return 0
+    }
+    return fileLockOwner(fileLockID(uint64(stat.Dev), stat.Ino))
+}
+
+// fileLockID formats the device and inode of a file the way /proc/<pid>/fdinfo shows them in lock lines
+func fileLockID(dev uint64, ino uint64) string {
+    major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+    minor := dev&0xff | (dev>>12)&^0xff
+    return fmt.Sprintf("%02x:%02x:%d", major, minor, ino)
+}
+
+// fileLockOwner returns the first process with a lock on the file id in its fdinfo, zero if not found
+func fileLockOwner(id string) int {
+    pids, err := process.ListPIDs()
+    if err != nil {
+        return 0
+    }
+    for _, pid := range pids {
+        dir := filepath.Join("/proc", strconv.Itoa(pid), "fdinfo")
+        infos, err := ioutil.ReadDir(dir)
+        if err != nil {
+            // the process exited or belongs to another user
+            continue
+        }
+        for _, info := range infos {
+            content, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+            if err == nil && holdsLock(content, id) {
+                return pid
+            }
+        }
+    }
+    return 0
+}
+
+// holdsLock checks the lock lines of a fdinfo file, like "lock:	1: OFDLCK ADVISORY  WRITE -1 fe:00:9617523 0 EOF"
+func holdsLock(fdinfo []byte, id string) bool {
+    scanner := bufio.NewScanner(bytes.NewReader(fdinfo))
+    for scanner.Scan() {
+        fields := bytes.Fields(scanner.Bytes())
+        if len(fields) >= 7 && string(fields[0]) == "lock:" && string(fields[6]) == id {
+            return true
+        }
+    }
+    return false
+}
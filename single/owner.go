@@ -0,0 +1,136 @@
+package single
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gaodb1210/go-common/process"
+)
+
+const deletedExeSuffix = " (deleted)"
+
+// AlreadyRunningError reports the running instance which holds the lock, it matches ErrAlreadyRunning with errors.Is
+type AlreadyRunningError struct {
+    // PID is the process id of the running instance, zero if unknown
+    PID int
+    // Since is the start time of the running instance, zero if unknown
+    Since time.Time
+    // Exe is the executable of the running instance, empty if unknown
+    Exe string
+}
+
+func (e *AlreadyRunningError) Error() string {
+    if e.PID == 0 {
+        return ErrAlreadyRunning.Error()
+    }
+    return fmt.Sprintf("%s: pid %d (%s) since %s", ErrAlreadyRunning, e.PID, e.Exe, e.Since.Format(time.RFC3339))
+}
+
+// Is reports whether target is ErrAlreadyRunning
+func (e *AlreadyRunningError) Is(target error) bool {
+    return target == ErrAlreadyRunning
+}
+
+// owner is the instance recorded in the pid file
+type owner struct {
+    pid int
+    // startTime is the start of the process since boot, from /proc/<pid>/stat
+    startTime time.Duration
+    exe string
+}
+
+// currentOwner returns the record of a running process
+func currentOwner(pid int) (*owner, error) {
+    stat, err := process.ReadStat(pid)
+    if err != nil {
+        return nil, err
+    }
+    exe, err := process.ReadExe(pid)
+    if err != nil {
+        return nil, err
+    }
+    return &owner{pid: pid, startTime: stat.StartTime, exe: exe}, nil
+}
+
+// readOwner reads the pid file, which holds the pid, the start time and the executable on separate lines,
+// a pid file with only the pid is also accepted
+func readOwner(pidFile string) (*owner, error) {
+    content, err := ioutil.ReadFile(pidFile)
+    if err != nil {
+        return nil, err
+    }
+    lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+    pid, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+    if err != nil || pid <= 0 {
+        return nil, fmt.Errorf("invalid pid file %s", pidFile)
+    }
+    o := &owner{pid: pid}
+    if len(lines) > 1 {
+        if o.startTime, err = time.ParseDuration(strings.TrimSpace(lines[1])); err != nil {
+            return nil, fmt.Errorf("invalid pid file %s: %v", pidFile, err)
+        }
+    }
+    if len(lines) > 2 {
+        o.exe = strings.TrimSpace(lines[2])
+    }
+    return o, nil
+}
+
+// writeOwner writes the record of the current process to the pid file
+func writeOwner(pidFile string) error {
+    o, err := currentOwner(os.Getpid())
+    if err != nil {
+        return err
+    }
+    content := fmt.Sprintf("%d\n%s\n%s\n", o.pid, o.startTime, o.exe)
+    tmp := pidFile + ".tmp"
+    if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, pidFile)
+}
+
+// alive reports whether the recorded process still runs the same program, a record without
+// start time or executable is compared to the current process instead
+func (o *owner) alive() bool {
+    running, err := currentOwner(o.pid)
+    if err != nil {
+        return false
+    }
+    if o.startTime != 0 && running.startTime != o.startTime {
+        return false
+    }
+    exe := o.exe
+    if exe == "" {
+        self, err := process.ReadExe(os.Getpid())
+        if err != nil {
+            return false
+        }
+        exe = self
+    }
+    return sameExe(running.exe, exe)
+}
+
+// sameExe compares the executables of two processes, the executable of a process which is replaced
+// on disk, like by an upgrade, ends with " (deleted)"
+func sameExe(a string, b string) bool {
+    return strings.TrimSuffix(a, deletedExeSuffix) == strings.TrimSuffix(b, deletedExeSuffix)
+}
+
+// runningError returns the error which describes the running process pid
+func runningError(pid int) *AlreadyRunningError {
+    e := &AlreadyRunningError{PID: pid}
+    if pid <= 0 {
+        e.PID = 0
+        return e
+    }
+    if stat, err := process.ReadStat(pid); err == nil {
+        e.Since, _ = stat.StartedAt()
+    }
+    e.Exe, _ = process.ReadExe(pid)
+    return e
+}
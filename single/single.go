@@ -2,20 +2,27 @@ package single
 
 // package single provides a mechanism to ensure, that only one instance of a program is running
 import (
+    "context"
     "errors"
     "fmt"
-    "io/ioutil"
     "log"
     "os"
     "path"
     "path/filepath"
-    "strconv"
-    "syscall"
+    "time"
+)
+
+const (
+    minLockRetryInterval = 50 * time.Millisecond
+    maxLockRetryInterval = 1 * time.Second
 )
 
 var (
     // ErrAlreadyRunning -- the instance is already running
     ErrAlreadyRunning = errors.New("the program is already running")
+
+    // errLockHeld is returned by acquire when it does not look up the holder of the lock
+    errLockHeld = errors.New("the lock is held")
 )
 
 // Single represents the name and the open file descriptor
@@ -24,6 +31,13 @@ type Single struct {
     lockFile string
     pidFile string
     file *os.File
+    cleanStale bool
+    backend int
+    handler ForwardHandler
+    forwardEnv []string
+    forwardTimeout time.Duration
+    listener *forwardServer
+    onWait func(owner *AlreadyRunningError)
 }
 
 // New creates a Single instance
@@ -49,46 +63,175 @@ func (s *Single) Unlock() {
     }
 }
 
-// CheckLock tries to obtain an exclude lock on a lockfile and returns an error if one occurs
+// CheckLock tries to obtain an exclude lock on a lockfile and returns an error if one occurs,
+// an *AlreadyRunningError describes the running instance which holds the lock
 func (s *Single) CheckLock() error {
+    return s.acquire(true)
+}
 
+// acquire tries to obtain the lock once. When the lock is held and lookup is false,
+// it returns errLockHeld without looking up the holder, which scans the open files of all processes.
+func (s *Single) acquire(lookup bool) error {
+    if len(s.pidFile) == 0 {
+        s.pidFile = path.Join(os.TempDir(), fmt.Sprintf("%s.pid", s.name))
+    }
     // open/create lock file
     f, err := os.OpenFile(s.fileName(), os.O_RDWR|os.O_CREATE, 0600)
     if err != nil {
         return err
     }
-    s.file = f
-    // set the lock type to F_WRLCK, therefore the file has to be opened writable
-    flock := syscall.Flock_t{
-        Type: syscall.F_WRLCK,
-        Pid:  int32(os.Getpid()),
+    // try to obtain an exclusive lock with the lock backend, the lock of a crashed process is released
+    // by the kernel, so a held lock file always belongs to a running process and is never removed
+    if err := s.tryLock(f); err != nil {
+        if !lookup {
+            _ = f.Close()
+            return errLockHeld
+        }
+        holder := s.lockHolder(f)
+        _ = f.Close()
+        recorded, _ := readOwner(s.pidFile)
+        if recorded != nil && recorded.alive() {
+            return runningError(recorded.pid)
+        }
+        if otherProgram(holder) {
+            log.Printf("the lock file %s is held by pid %d, which is not an instance of this program", s.fileName(), holder)
+        }
+        return runningError(holder)
     }
-    // try to obtain an exclusive lock - FcntlFlock seems to be the portable *ix way
-    if err := syscall.FcntlFlock(s.file.Fd(), syscall.F_SETLK, &flock); err != nil {
-        return ErrAlreadyRunning
+    // the lock file may be removed by the previous owner between the open and the lock,
+    // then the lock is taken on an unlinked inode and the lock file is opened again
+    if !s.lockedCurrent(f) {
+        _ = s.unlock(f)
+        _ = f.Close()
+        return s.acquire(lookup)
     }
-    // write pid file
-    if len(s.pidFile) == 0 {
-        s.pidFile = path.Join(os.TempDir(), fmt.Sprintf("%s.pid", s.name))
+    // the pid file is checked once the lock is obtained
+    if recorded, err := readOwner(s.pidFile); err == nil && recorded.pid != os.Getpid() {
+        if recorded.alive() {
+            // a running instance lost its lock file, e.g. it was removed by hand, it is never taken over
+            _ = s.unlock(f)
+            _ = f.Close()
+            return runningError(recorded.pid)
+        }
+        if s.cleanStale {
+            // the files of a crashed instance or another program, the lock file is created again
+            log.Printf("clean the stale lock file %s and pid file %s of pid %d", s.fileName(), s.pidFile, recorded.pid)
+            _ = s.unlock(f)
+            _ = f.Close()
+            if err := os.Remove(s.pidFile); err != nil && !os.IsNotExist(err) {
+                return err
+            }
+            if err := os.Remove(s.fileName()); err != nil && !os.IsNotExist(err) {
+                return err
+            }
+            return s.acquire(lookup)
+        }
+        log.Printf("replace the stale pid file %s of pid %d", s.pidFile, recorded.pid)
+    }
+    s.file = f
+    if err := writeOwner(s.pidFile); err != nil {
+        log.Printf("write the pid file %s: %v", s.pidFile, err)
+    }
+    if s.handler != nil {
+        if err := s.listen(); err != nil {
+            log.Printf("listen on the socket %s: %v", s.socketName(), err)
+        }
     }
-    var d1 = []byte(strconv.Itoa(os.Getpid()))
-    _ = ioutil.WriteFile(s.pidFile, d1, 0666)
     return nil
 }
 
+// lockedCurrent reports whether f is still the file at the lock file path, by device and inode
+func (s *Single) lockedCurrent(f *os.File) bool {
+    locked, err := f.Stat()
+    if err != nil {
+        return false
+    }
+    current, err := os.Stat(s.fileName())
+    if err != nil {
+        return false
+    }
+    return os.SameFile(locked, current)
+}
+
+// LockContext waits until it obtains the lock or ctx is done, it polls the lock with backoff.
+// The running instance is looked up for the wait callback when it starts waiting, and once more
+// when ctx is done, then the *AlreadyRunningError of the last attempt is returned.
+func (s *Single) LockContext(ctx context.Context) error {
+    interval := minLockRetryInterval
+    reported := false
+    for {
+        err := s.acquire(!reported && s.onWait != nil)
+        var running *AlreadyRunningError
+        if err == nil || (err != errLockHeld && !errors.As(err, &running)) {
+            return err
+        }
+        if running != nil && !reported {
+            reported = true
+            if s.onWait != nil {
+                s.onWait(running)
+            }
+        }
+        timer := time.NewTimer(interval)
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            timer.Stop()
+            return s.CheckLock()
+        }
+        if interval *= 2; interval > maxLockRetryInterval {
+            interval = maxLockRetryInterval
+        }
+    }
+}
+
+// LockTimeout waits up to timeout until it obtains the lock, see LockContext
+func (s *Single) LockTimeout(timeout time.Duration) error {
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    return s.LockContext(ctx)
+}
+
+// SetWaitCallback set the callback called by LockContext when it starts waiting for a running instance
+func (s *Single) SetWaitCallback(onWait func(owner *AlreadyRunningError)) {
+    s.onWait = onWait
+}
+
+// SetCleanStale set whether CheckLock removes the lock file and the pid file left by a crashed instance
+// or another program before it locks a new lock file, without it the lock file is reused and the pid file replaced.
+// A running instance of this program recorded in the pid file is never taken over.
+func (s *Single) SetCleanStale(cleanStale bool) {
+    s.cleanStale = cleanStale
+}
+
+// otherProgram reports whether the lock holder is known to run another program, it is only reported
+func otherProgram(holder int) bool {
+    if holder <= 0 {
+        return false
+    }
+    self, err := currentOwner(os.Getpid())
+    if err != nil {
+        return false
+    }
+    running, err := currentOwner(holder)
+    return err == nil && !sameExe(running.exe, self.exe)
+}
+
 // TryUnlock unlocks, closes and removes the lockfile
 func (s *Single) TryUnlock() error {
-    // set the lock type to F_UNLCK
-    flock := syscall.Flock_t{
-        Type: syscall.F_UNLCK,
-        Pid:  int32(os.Getpid()),
+    if s.file == nil {
+        return fmt.Errorf("the lock file %s is not locked", s.fileName())
+    }
+    if s.listener != nil {
+        _ = s.listener.Close()
+        s.listener = nil
     }
-    if err := syscall.FcntlFlock(s.file.Fd(), syscall.F_SETLK, &flock); err != nil {
+    if err := s.unlock(s.file); err != nil {
         return fmt.Errorf("failed to unlock the lock file: %v", err)
     }
     if err := s.file.Close(); err != nil {
         return fmt.Errorf("failed to close the lock file: %v", err)
     }
+    s.file = nil
     if err := os.Remove(s.fileName()); err != nil {
         return fmt.Errorf("failed to remove the lock file: %v", err)
     }
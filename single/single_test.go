@@ -0,0 +1,445 @@
+package single
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+const (
+    helperLockEnv = "SINGLE_HELPER_LOCK"
+    helperPidEnv = "SINGLE_HELPER_PID"
+    helperBackendEnv = "SINGLE_HELPER_BACKEND"
+    helperForwardEnv = "SINGLE_HELPER_FORWARD"
+)
+
+// TestHelperProcess holds the lock in a child process started by startHelper
+func TestHelperProcess(t *testing.T) {
+    lockFile := os.Getenv(helperLockEnv)
+    if lockFile == "" {
+        return
+    }
+    s := New("helper", lockFile, os.Getenv(helperPidEnv))
+    backend, _ := strconv.Atoi(os.Getenv(helperBackendEnv))
+    s.SetLockBackend(backend)
+    if os.Getenv(helperForwardEnv) != "" {
+        // exits with the code replied by the primary instance
+        s.SetForwardEnv(helperForwardEnv)
+        s.LockOrForward()
+    }
+    if err := s.CheckLock(); err != nil {
+        fmt.Println(err)
+        os.Exit(2)
+    }
+    fmt.Println("locked")
+    time.Sleep(10 * time.Second)
+    os.Exit(0)
+}
+
+// startHelper starts exe holding the lock, exe is a copy of the test binary or the test binary itself
+func startHelper(t *testing.T, exe string, lockFile string, pidFile string) *exec.Cmd {
+    cmd, line := runHelper(t, exe, LockOFD, lockFile, pidFile)
+    if line != "locked" {
+        stopHelper(cmd)
+        t.Fatalf("helper failed to lock: %q", line)
+    }
+    return cmd
+}
+
+// runHelper starts exe trying to lock with the lock backend, and returns the first line it prints
+func runHelper(t *testing.T, exe string, backend int, lockFile string, pidFile string) (*exec.Cmd, string) {
+    cmd := exec.Command(exe, "-test.run=^TestHelperProcess$")
+    cmd.Env = append(os.Environ(), helperLockEnv+"="+lockFile, helperPidEnv+"="+pidFile,
+        helperBackendEnv+"="+strconv.Itoa(backend))
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := cmd.Start(); err != nil {
+        t.Fatal(err)
+    }
+    line, _ := bufio.NewReader(stdout).ReadString('\n')
+    return cmd, strings.TrimSpace(line)
+}
+
+func stopHelper(cmd *exec.Cmd) {
+    _ = cmd.Process.Kill()
+    _ = cmd.Wait()
+}
+
+func tempDir(t *testing.T) string {
+    dir, err := ioutil.TempDir("", "single")
+    if err != nil {
+        t.Fatal(err)
+    }
+    return dir
+}
+
+func TestSingle_AlreadyRunning(t *testing.T) {
+    dir := tempDir(t)
+    defer os.RemoveAll(dir)
+    lockFile, pidFile := filepath.Join(dir, "test.lock"), filepath.Join(dir, "test.pid")
+    helper := startHelper(t, os.Args[0], lockFile, pidFile)
+    defer stopHelper(helper)
+
+    err := New("test", lockFile, pidFile).CheckLock()
+    var running *AlreadyRunningError
+    if !errors.Is(err, ErrAlreadyRunning) || !errors.As(err, &running) {
+        t.Fatalf("expect %v, got %v", ErrAlreadyRunning, err)
+    }
+    self, _ := os.Executable()
+    if running.PID != helper.Process.Pid || running.Exe != self || time.Since(running.Since) > time.Minute {
+        t.Errorf("unexpected owner %+v", running)
+    }
+}
+
+func TestSingle_StalePidFile(t *testing.T) {
+    dir := tempDir(t)
+    defer os.RemoveAll(dir)
+    lockFile, pidFile := filepath.Join(dir, "test.lock"), filepath.Join(dir, "test.pid")
+    // a crashed instance left its lock and pid files
+    if err := ioutil.WriteFile(lockFile, nil, 0600); err != nil {
+        t.Fatal(err)
+    }
+    if err := ioutil.WriteFile(pidFile, []byte("1\n1s\n/bin/crashed\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    s := New("test", lockFile, pidFile)
+    if err := s.CheckLock(); err != nil {
+        t.Fatal(err)
+    }
+    content, _ := ioutil.ReadFile(pidFile)
+    if pid, _ := strconv.Atoi(strings.SplitN(string(content), "\n", 2)[0]); pid != os.Getpid() {
+        t.Errorf("expect pid file of the current process, got %q", content)
+    }
+    if err := s.TryUnlock(); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestSingle_OtherProgram(t *testing.T) {
+    dir := tempDir(t)
+    defer os.RemoveAll(dir)
+    lockFile, pidFile := filepath.Join(dir, "test.lock"), filepath.Join(dir, "test.pid")
+    // another program holds the lock
+    other := filepath.Join(dir, "other")
+    if err := copyFile(os.Args[0], other); err != nil {
+        t.Fatal(err)
+    }
+    helper := startHelper(t, other, lockFile, filepath.Join(dir, "other.pid"))
+    defer stopHelper(helper)
+
+    // the held lock file is never taken over
+    s := New("test", lockFile, pidFile)
+    s.SetCleanStale(true)
+    var running *AlreadyRunningError
+    if err := s.CheckLock(); !errors.As(err, &running) || running.PID != helper.Process.Pid || running.Exe != other {
+        t.Fatalf("expect the lock held by pid %d, got %v", helper.Process.Pid, err)
+    }
+    if _, err := os.Stat(lockFile); err != nil {
+        t.Errorf("expect the lock file kept, got %v", err)
+    }
+}
+
+func TestSingle_CleanStale(t *testing.T) {
+    dir := tempDir(t)
+    defer os.RemoveAll(dir)
+    lockFile, pidFile := filepath.Join(dir, "test.lock"), filepath.Join(dir, "test.pid")
+    // a running instance whose lock file was removed, it holds another lock file
+    helper := startHelper(t, os.Args[0], filepath.Join(dir, "removed.lock"), pidFile)
+    s := New("test", lockFile, pidFile)
+    s.SetCleanStale(true)
+    var running *AlreadyRunningError
+    if err := s.CheckLock(); !errors.As(err, &running) || running.PID != helper.Process.Pid {
+        t.Fatalf("expect the instance of pid %d running, got %v", helper.Process.Pid, err)
+    }
+    // the lock is released again
+    other := New("other", lockFile, filepath.Join(dir, "other.pid"))
+    if err := other.CheckLock(); err != nil {
+        t.Fatalf("expect the lock released, got %v", err)
+    }
+    other.Unlock()
+
+    // the files of the crashed instance are removed, and the lock file is created again
+    stopHelper(helper)
+    if err := ioutil.WriteFile(lockFile, nil, 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.CheckLock(); err != nil {
+        t.Fatal(err)
+    }
+    if info, err := os.Stat(lockFile); err != nil || info.Mode().Perm() != 0600 {
+        t.Errorf("expect a new lock file, got %v", err)
+    }
+    content, _ := ioutil.ReadFile(pidFile)
+    if pid, _ := strconv.Atoi(strings.SplitN(string(content), "\n", 2)[0]); pid != os.Getpid() {
+        t.Errorf("expect pid file of the current process, got %q", content)
+    }
+    if err := s.TryUnlock(); err != nil {
+        t.Error(err)
+    }
+}
+
+func copyFile(src string, dst string) error {
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(out, in); err != nil {
+        _ = out.Close()
+        return err
+    }
+    return out.Close()
+}
+
+func TestSingle_LockTimeout(t *testing.T) {
+    dir := tempDir(t)
+    defer os.RemoveAll(dir)
+    lockFile, pidFile := filepath.Join(dir, "test.lock"), filepath.Join(dir, "test.pid")
+    helper := startHelper(t, os.Args[0], lockFile, pidFile)
+    defer stopHelper(helper)
+
+    s := New("test", lockFile, pidFile)
+    var waited []int
+    s.SetWaitCallback(func(owner *AlreadyRunningError) {
+        waited = append(waited, owner.PID)
+    })
+    start := time.Now()
+    if err := s.LockTimeout(300 * time.Millisecond); !errors.Is(err, ErrAlreadyRunning) || time.Since(start) < 300*time.Millisecond {
+        t.Fatalf("expect %v after the timeout, got %v", ErrAlreadyRunning, err)
+    }
+    if len(waited) != 1 || waited[0] != helper.Process.Pid {
+        t.Errorf("expect to wait for pid %d once, got %v", helper.Process.Pid, waited)
+    }
+
+    killed := make(chan struct{})
+    time.AfterFunc(300*time.Millisecond, func() {
+        _ = helper.Process.Kill()
+        close(killed)
+    })
+    if err := s.LockTimeout(5 * time.Second); err != nil {
+        t.Fatal(err)
+    }
+    <-killed
+    if err := s.TryUnlock(); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestSingle_LockBackends(t *testing.T) {
+    dir := tempDir(t)
+    defer os.RemoveAll(dir)
+    for _, test := range []struct {
+        name string
+        backend int
+        // whether the lock survives closing another descriptor of the lock file
+        survives bool
+    }{
+        {"ofd", LockOFD, true},
+        {"flock", LockFlock, true},
+        {"fcntl", LockFcntl, false},
+    } {
+        t.Run(test.name, func(t *testing.T) {
+            lockFile, pidFile := filepath.Join(dir, test.name+".lock"), filepath.Join(dir, test.name+".pid")
+            s := New("test", lockFile, pidFile)
+            s.SetLockBackend(test.backend)
+            if err := s.CheckLock(); err != nil {
+                t.Fatal(err)
+            }
+            defer s.Unlock()
+            // an unrelated open and close of the lock file, like reading it
+            if _, err := ioutil.ReadFile(lockFile); err != nil {
+                t.Fatal(err)
+            }
+            helper, line := runHelper(t, os.Args[0], test.backend, lockFile, filepath.Join(dir, test.name+".helper.pid"))
+            stopHelper(helper)
+            if locked := line == "locked"; locked == test.survives {
+                t.Errorf("expect the lock to survive %v, the helper printed %q", test.survives, line)
+            }
+        })
+    }
+}
+
+func TestSingle_SameProcess(t *testing.T) {
+    dir := tempDir(t)
+    defer os.RemoveAll(dir)
+    for _, backend := range []int{LockOFD, LockFlock} {
+        lockFile, pidFile := filepath.Join(dir, "test.lock"), filepath.Join(dir, "test.pid")
+        first := New("test", lockFile, pidFile)
+        first.SetLockBackend(backend)
+        if err := first.CheckLock(); err != nil {
+            t.Fatal(err)
+        }
+        // another goroutine of the same process is refused
+        errs := make(chan error)
+        go func() {
+            second := New("test", lockFile, pidFile)
+            second.SetLockBackend(backend)
+            errs <- second.CheckLock()
+        }()
+        var running *AlreadyRunningError
+        if err := <-errs; !errors.As(err, &running) || running.PID != os.Getpid() {
+            t.Errorf("backend %d: expect the lock held by the current process, got %v", backend, err)
+        }
+        if err := first.TryUnlock(); err != nil {
+            t.Error(err)
+        }
+    }
+}
+
+func TestSingle_RemovedLockFile(t *testing.T) {
+    dir := tempDir(t)
+    defer os.RemoveAll(dir)
+    lockFile, pidFile := filepath.Join(dir, "test.lock"), filepath.Join(dir, "test.pid")
+    first := New("test", lockFile, pidFile)
+    if err := first.CheckLock(); err != nil {
+        t.Fatal(err)
+    }
+    // the second instance opens the lock file before the first one unlocks and removes it
+    second := New("test", lockFile, pidFile)
+    f, err := os.OpenFile(lockFile, os.O_RDWR, 0600)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    if err := first.TryUnlock(); err != nil {
+        t.Fatal(err)
+    }
+    third := New("test", lockFile, pidFile)
+    if err := third.CheckLock(); err != nil {
+        t.Fatal(err)
+    }
+    defer third.Unlock()
+    // the lock on the unlinked inode succeeds, but it is not the current lock file
+    if err := second.tryLock(f); err != nil {
+        t.Fatal(err)
+    }
+    if second.lockedCurrent(f) {
+        t.Error("expect the lock on the removed lock file not to be current")
+    }
+    _ = second.unlock(f)
+    if err := second.CheckLock(); err == nil {
+        t.Error("expect the lock held by the third instance")
+    }
+}
+
+func TestSingle_LockHolder(t *testing.T) {
+    dir := tempDir(t)
+    defer os.RemoveAll(dir)
+    lockFile := filepath.Join(dir, "test.lock")
+    for _, backend := range []int{LockOFD, LockFlock, LockFcntl} {
+        helper, line := runHelper(t, os.Args[0], backend, lockFile, filepath.Join(dir, "helper.pid"))
+        if line != "locked" {
+            stopHelper(helper)
+            t.Fatalf("backend %d: helper failed to lock: %q", backend, line)
+        }
+        s := New("test", lockFile, filepath.Join(dir, "test.pid"))
+        s.SetLockBackend(backend)
+        f, err := os.OpenFile(lockFile, os.O_RDWR, 0600)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if holder := s.lockHolder(f); holder != helper.Process.Pid {
+            t.Errorf("backend %d: expect lock holder %d, got %d", backend, helper.Process.Pid, holder)
+        }
+        _ = f.Close()
+        stopHelper(helper)
+    }
+}
+
+func TestSingle_Forward(t *testing.T) {
+    dir := tempDir(t)
+    defer os.RemoveAll(dir)
+    lockFile, pidFile := filepath.Join(dir, "test.lock"), filepath.Join(dir, "test.pid")
+    messages := make(chan *Message, 1)
+    primary := New("test", lockFile, pidFile)
+    primary.SetForwardHandler(func(msg *Message) int {
+        messages <- msg
+        return 3
+    })
+    if err := primary.CheckLock(); err != nil {
+        t.Fatal(err)
+    }
+
+    os.Setenv("SINGLE_TEST_FORWARD", "value")
+    defer os.Unsetenv("SINGLE_TEST_FORWARD")
+    second := New("test", lockFile, pidFile)
+    second.SetForwardEnv("SINGLE_TEST_FORWARD", "SINGLE_TEST_MISSING")
+    if err := second.CheckLock(); !errors.Is(err, ErrAlreadyRunning) {
+        t.Fatalf("expect ErrAlreadyRunning, got %v", err)
+    }
+    // a client which sends nothing does not block the forward
+    silent, err := net.Dial("unix", primary.socketName())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer silent.Close()
+    second.SetForwardTimeout(time.Second)
+    code, err := second.Forward()
+    if err != nil || code != 3 {
+        t.Fatalf("expect exit code 3, got %d, %v", code, err)
+    }
+    msg := <-messages
+    wd, _ := os.Getwd()
+    if msg.PID != os.Getpid() || strings.Join(msg.Args, " ") != strings.Join(os.Args, " ") || msg.Dir != wd {
+        t.Errorf("unexpected message %+v", msg)
+    }
+    if len(msg.Env) != 1 || msg.Env["SINGLE_TEST_FORWARD"] != "value" {
+        t.Errorf("unexpected env %v", msg.Env)
+    }
+
+    if err := primary.TryUnlock(); err != nil {
+        t.Error(err)
+    }
+    if _, err := os.Stat(primary.socketName()); !os.IsNotExist(err) {
+        t.Errorf("expect the socket removed, got %v", err)
+    }
+    second.SetForwardTimeout(100 * time.Millisecond)
+    if _, err := second.Forward(); err == nil {
+        t.Error("expect an error without a running instance")
+    }
+}
+
+func TestSingle_LockOrForward(t *testing.T) {
+    dir := tempDir(t)
+    defer os.RemoveAll(dir)
+    lockFile, pidFile := filepath.Join(dir, "test.lock"), filepath.Join(dir, "test.pid")
+    messages := make(chan *Message, 1)
+    primary := New("test", lockFile, pidFile)
+    primary.SetForwardHandler(func(msg *Message) int {
+        messages <- msg
+        return 3
+    })
+    if err := primary.CheckLock(); err != nil {
+        t.Fatal(err)
+    }
+    defer primary.Unlock()
+
+    // the second instance forwards and exits with the replied code
+    cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+    cmd.Env = append(os.Environ(), helperLockEnv+"="+lockFile, helperPidEnv+"="+pidFile, helperForwardEnv+"=1")
+    output, err := cmd.Output()
+    var exitErr *exec.ExitError
+    if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+        t.Fatalf("expect exit code 3, got %v, output %q", err, output)
+    }
+    msg := <-messages
+    if msg.PID != cmd.Process.Pid || len(msg.Args) == 0 || msg.Args[0] != os.Args[0] || msg.Env[helperForwardEnv] != "1" {
+        t.Errorf("unexpected message %+v", msg)
+    }
+}